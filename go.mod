@@ -2,7 +2,10 @@ module blind
 
 go 1.23.3
 
-require github.com/miekg/dns v1.1.62
+require (
+	github.com/miekg/dns v1.1.62
+	golang.org/x/crypto v0.25.0
+)
 
 require (
 	golang.org/x/mod v0.18.0 // indirect
@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
 
 	"blind/tunnel"
 )
@@ -19,58 +21,239 @@ Usage: %s [options]
 
 Server Mode Options:
   -server-listen string    Address to listen for DNS requests (e.g., "0.0.0.0:53")
-  -server-dest string      Destination address to forward traffic (e.g., "10.0.0.1:22")
+  -server-dest string      Destination address to forward traffic (e.g., "10.0.0.1:22");
+                           SOCKS5 and HTTP proxy connections go to the target the client names instead
+                           when -allow-any-destination or -policy permits it
+  -map name=host:port      Named destination clients can select with -forward (repeatable or comma-separated)
+  -authorized-keys string  File of client public keys allowed to connect (requires -key)
+  -allow-reverse string    File of rules for the addresses clients may ask the server to listen on (-reverse)
+  -policy string           File of rules for the targets clients name (SOCKS5, HTTP proxy, UDP forwards)
+  -allow-any-destination   Let clients open streams to any target they name, even without -policy
+  -zone-ns string          Comma-separated nameserver names for the -domain zone (default ns.<domain>)
+  -zone-ip string          Comma-separated A/AAAA addresses for the zone apex and its nameservers
+  -zone-mbox string        SOA responsible mailbox (default hostmaster.<domain>)
+  -upstream string         Resolver for questions outside -domain (e.g., "1.1.1.1:53")
+  -tls-listen string       Address to serve DNS over TLS on (e.g., "0.0.0.0:853"; requires -tls-cert and -tls-key)
+  -tls-cert string         PEM certificate file for DNS over TLS
+  -tls-key string          PEM private key file for DNS over TLS
 
 Client Mode Options:
   -client-listen string    Local address to listen for TCP connections (e.g., "127.0.0.1:2222")
-  -client-dest string      DNS server address to tunnel through (e.g., "8.8.8.8:53")
+  -forward port=name       Local port whose connections go to the server's mapping of that name
+                           (e.g., "2222=ssh" or "0.0.0.0:2222=ssh"; repeatable or comma-separated)
+  -reverse port=host:port  Server port whose connections are dialed to host:port from the client
+                           (e.g., "8022=127.0.0.1:22" or "0.0.0.0:8022=127.0.0.1:22"; repeatable)
+  -udp-forward port=dest   Local UDP port whose datagrams the server sends to the UDP host:port dest,
+                           returning replies (e.g., "51820=10.0.0.1:51820"; repeatable or comma-separated)
+  -socks5 string           Local address to accept SOCKS5 CONNECT requests on (e.g., "127.0.0.1:1080")
+  -http-proxy string       Local address to accept HTTP proxy requests on (e.g., "127.0.0.1:8080")
+  -client-dest string      Comma-separated DNS servers to tunnel through (e.g., "8.8.8.8:53,1.1.1.1"),
+                           DNS over TLS resolvers (e.g., "tls://dns.example.com:853"),
+                           DNS over HTTPS URLs (e.g., "https://dns.example.com/dns-query")
+                           or "system" for the nameservers in /etc/resolv.conf
+  -tls-ca string           PEM certificates to verify a DNS over TLS or HTTPS resolver with
+  -doh-method string       HTTP method for DNS over HTTPS queries: POST or GET (default "POST")
+  -window int              Maximum queries in flight per session (default 8)
+  -server-key string       Server public key to handshake with (requires -key)
+  -codec string            Query name encoding: auto, base32, base36, base64 or raw (default "auto")
+  -tcp                     Send queries over TCP instead of UDP
+  -record-type string      Answer type for downstream data: auto, TXT, NULL, CNAME, MX, SRV, A, AAAA or PRIVATE (default "auto")
 
 Common Options:
+  -domain string          Zone delegated to the server (e.g., "t.example.com")
+  -psk string             Pre-shared key; encrypts and authenticates every frame
+  -psk-file string        Read the pre-shared key from a file
+  -key string             Private key file identifying this side in the handshake
+  -genkey string          Write a new private key to this file, print its public key and exit
   -debug                  Enable debug logging
   -h                      Show this help message
 
 Examples:
+  # Generate keys, then list the client's public key in authorized_keys:
+  %s -genkey server.key
+  %s -genkey client.key
+
   # Run server listening on UDP port 53, forwarding to SSH server:
   sudo %s -server-listen 0.0.0.0:53 -server-dest 10.0.0.1:22
 
   # Run client listening on local port 2222, tunneling through DNS server:
   %s -client-listen 127.0.0.1:2222 -client-dest dns.example.com:53
 
-`, os.Args[0], os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	}
 }
 
 func main() {
 	// Client flags
 	clientListen := flag.String("client-listen", "", "(e.g., 127.0.0.1:8080) Local TCP port to listen on")
-	clientDest := flag.String("client-dest", "", "(e.g., 10.0.0.1:53) Remote DNS server address")
+	clientDest := flag.String("client-dest", "", "(e.g., 10.0.0.1:53) Comma-separated DNS servers, tls:// or https:// resolvers, or \"system\"")
+	var forwards listFlag
+	flag.Var(&forwards, "forward", "(e.g., 2222=ssh) Local port carried to the server's named mapping")
+	var reverses listFlag
+	flag.Var(&reverses, "reverse", "(e.g., 8022=127.0.0.1:22) Server port carried back to a local address")
+	var udpForwards listFlag
+	flag.Var(&udpForwards, "udp-forward", "(e.g., 51820=10.0.0.1:51820) Local UDP port carried to a UDP destination")
+	socks5 := flag.String("socks5", "", "(e.g., 127.0.0.1:1080) Local SOCKS5 listen address")
+	httpProxy := flag.String("http-proxy", "", "(e.g., 127.0.0.1:8080) Local HTTP proxy listen address")
+	window := flag.Int("window", 8, "Maximum queries in flight per session")
+	serverKey := flag.String("server-key", "", "Server public key to handshake with")
+	codec := flag.String("codec", "auto", "Query name encoding: auto, base32, base36, base64 or raw")
+	recordType := flag.String("record-type", "auto", "Answer type for downstream data")
+	useTCP := flag.Bool("tcp", false, "Send queries over TCP instead of UDP")
+	dohMethod := flag.String("doh-method", "POST", "HTTP method for DNS over HTTPS queries: POST or GET")
+	tlsCA := flag.String("tls-ca", "", "PEM certificates to verify a DNS over TLS or HTTPS resolver with")
 
 	// Server flags
 	serverListen := flag.String("server-listen", "", "(e.g., 0.0.0.0:53) DNS listen address")
 	serverDest := flag.String("server-dest", "", "(e.g., 127.0.0.1:80) Destination TCP address to forward to")
+	authorizedKeys := flag.String("authorized-keys", "", "File of client public keys allowed to connect")
+	var mappings listFlag
+	flag.Var(&mappings, "map", "(e.g., ssh=127.0.0.1:22) Named destination clients can select")
+	allowReverse := flag.String("allow-reverse", "", "File of rules for the addresses clients may ask the server to listen on")
+	policy := flag.String("policy", "", "File of rules for the targets clients may open streams to")
+	anyDestination := flag.Bool("allow-any-destination", false, "Let clients open streams to any target they name")
+	zoneNS := flag.String("zone-ns", "", "Comma-separated nameserver names for the zone")
+	zoneIP := flag.String("zone-ip", "", "Comma-separated addresses for the zone apex and nameservers")
+	zoneMbox := flag.String("zone-mbox", "", "SOA responsible mailbox")
+	upstream := flag.String("upstream", "", "(e.g., 1.1.1.1:53) Resolver for questions outside the tunnel domain")
+	tlsListen := flag.String("tls-listen", "", "(e.g., 0.0.0.0:853) DNS over TLS listen address")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file for DNS over TLS")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for DNS over TLS")
+
+	// Common flags
+	domain := flag.String("domain", "", "(e.g., t.example.com) Zone delegated to the tunnel server")
+	psk := flag.String("psk", "", "Pre-shared key used to encrypt and authenticate frames")
+	pskFile := flag.String("psk-file", "", "File containing the pre-shared key")
+	keyFile := flag.String("key", "", "Private key file for the handshake")
+	genKey := flag.String("genkey", "", "Write a new private key to this file and print its public key")
 
 	debug := flag.Bool("debug", false, "Enable debug logging")
 	flag.Parse()
 
+	if *genKey != "" {
+		identity, err := tunnel.GenerateKeyPair()
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		if err := identity.Save(*genKey); err != nil {
+			log.Fatalf("Failed to write key: %v", err)
+		}
+		fmt.Printf("Private key written to %s\n", *genKey)
+		fmt.Printf("Public key: %s\n", identity.PublicKey())
+		os.Exit(0)
+	}
+
+	key, err := loadPSK(*psk, *pskFile)
+	if err != nil {
+		log.Fatalf("Failed to load pre-shared key: %v", err)
+	}
+
+	var identity *tunnel.KeyPair
+	if *keyFile != "" {
+		identity, err = tunnel.LoadKeyPair(*keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load key: %v", err)
+		}
+	}
+
 	// Server mode if server flags are set
-	if *serverListen != "" || *serverDest != "" {
-		if *serverListen == "" || *serverDest == "" {
-			fmt.Println("Error: both server-listen and server-dest are required for server mode")
+	if *serverListen != "" || *serverDest != "" || len(mappings) > 0 {
+		if *serverListen == "" {
+			fmt.Println("Error: server-listen is required for server mode")
 			fmt.Println("Example: ./blind -server-listen 0.0.0.0:53 -server-dest 127.0.0.1:80")
 			flag.Usage()
 			os.Exit(1)
 		}
 		server := tunnel.NewDNSServer(*serverListen, *serverDest, *debug)
+		server.SetDomain(*domain)
+		server.SetAnyDestination(*anyDestination)
+		for _, mapping := range mappings {
+			name, dest, ok := strings.Cut(mapping, "=")
+			if !ok {
+				log.Fatalf("Invalid mapping %q, expected name=host:port", mapping)
+			}
+			if err := server.AddMapping(name, dest); err != nil {
+				log.Fatalf("Invalid mapping: %v", err)
+			}
+		}
+		records, err := zoneRecords(*zoneNS, *zoneIP, *zoneMbox)
+		if err != nil {
+			log.Fatalf("Invalid zone records: %v", err)
+		}
+		server.SetZoneRecords(records)
+		if *upstream != "" {
+			if *domain == "" {
+				log.Fatalf("-upstream requires -domain to tell tunnel queries apart")
+			}
+			server.SetUpstream(*upstream)
+		}
+		if *tlsListen != "" || *tlsCert != "" || *tlsKey != "" {
+			if *tlsListen == "" || *tlsCert == "" || *tlsKey == "" {
+				log.Fatalf("-tls-listen, -tls-cert and -tls-key must be used together")
+			}
+			if err := server.SetTLS(*tlsListen, *tlsCert, *tlsKey); err != nil {
+				log.Fatalf("Failed to set up DNS over TLS: %v", err)
+			}
+		}
+		if *policy != "" {
+			rules, err := tunnel.LoadDestinationPolicy(*policy)
+			if err != nil {
+				log.Fatalf("Failed to load destination policy: %v", err)
+			}
+			server.SetDestinationPolicy(rules)
+		}
+		if *allowReverse != "" {
+			rules, err := tunnel.LoadDestinationPolicy(*allowReverse)
+			if err != nil {
+				log.Fatalf("Failed to load reverse forwarding policy: %v", err)
+			}
+			server.SetReversePolicy(rules)
+		}
+		if key != nil {
+			server.SetPSK(key)
+		}
+		if identity != nil || *authorizedKeys != "" {
+			if identity == nil || *authorizedKeys == "" {
+				log.Fatalf("-key and -authorized-keys must be used together")
+			}
+			keys, err := tunnel.LoadAuthorizedKeys(*authorizedKeys)
+			if err != nil {
+				log.Fatalf("Failed to load authorized keys: %v", err)
+			}
+			server.SetIdentity(identity, keys)
+			log.Printf("Server public key: %s (%d authorized clients)", identity.PublicKey(), len(keys))
+		}
 		log.Printf("Starting DNS tunnel server:")
 		log.Printf("  DNS listening on: %s", *serverListen)
-		log.Printf("  Forwarding to: %s", *serverDest)
+		if *serverDest != "" {
+			log.Printf("  Forwarding to: %s", *serverDest)
+		}
+		for _, mapping := range mappings {
+			log.Printf("  Mapping: %s", mapping)
+		}
+		if *policy != "" {
+			log.Printf("  Destination policy: %s", *policy)
+		}
+		if *anyDestination {
+			log.Printf("  Clients may open streams to any target")
+		}
+		if *allowReverse != "" {
+			log.Printf("  Reverse forwarding policy: %s", *allowReverse)
+		}
+		if *upstream != "" {
+			log.Printf("  Other queries to: %s", *upstream)
+		}
+		if *tlsListen != "" {
+			log.Printf("  DNS over TLS on: %s", *tlsListen)
+		}
 		log.Fatal(server.Start())
 	}
 
 	// Client mode if client flags are set
-	if *clientListen != "" || *clientDest != "" {
-		if *clientListen == "" || *clientDest == "" {
-			fmt.Println("Error: both client-listen and client-dest are required for client mode")
+	clientListeners := len(forwards) + len(reverses) + len(udpForwards)
+	if *clientListen != "" || *clientDest != "" || clientListeners > 0 || *socks5 != "" || *httpProxy != "" {
+		if (*clientListen == "" && clientListeners == 0 && *socks5 == "" && *httpProxy == "") || *clientDest == "" {
+			fmt.Println("Error: client-dest and one of client-listen, forward, reverse, udp-forward, socks5 or http-proxy are required for client mode")
 			fmt.Println("Example: ./blind -client-listen 127.0.0.1:8080 -client-dest 10.0.0.1:53")
 			flag.Usage()
 			os.Exit(1)
@@ -79,9 +262,94 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to create DNS client: %v", err)
 		}
+		client.SetWindowSize(*window)
+		for _, spec := range forwards {
+			addr, name, ok := strings.Cut(spec, "=")
+			if !ok {
+				log.Fatalf("Invalid forward %q, expected [addr:]port=name", spec)
+			}
+			if !strings.Contains(addr, ":") {
+				addr = net.JoinHostPort("127.0.0.1", addr)
+			}
+			if err := client.AddForward(addr, name); err != nil {
+				log.Fatalf("Invalid forward: %v", err)
+			}
+		}
+		for _, spec := range udpForwards {
+			addr, target, ok := strings.Cut(spec, "=")
+			if !ok {
+				log.Fatalf("Invalid UDP forward %q, expected [addr:]port=host:port", spec)
+			}
+			if !strings.Contains(addr, ":") {
+				addr = net.JoinHostPort("127.0.0.1", addr)
+			}
+			if err := client.AddUDPForward(addr, target); err != nil {
+				log.Fatalf("Invalid UDP forward: %v", err)
+			}
+		}
+		for _, spec := range reverses {
+			remote, local, ok := strings.Cut(spec, "=")
+			if !ok {
+				log.Fatalf("Invalid reverse forward %q, expected [addr:]port=host:port", spec)
+			}
+			if !strings.Contains(remote, ":") {
+				remote = net.JoinHostPort("127.0.0.1", remote)
+			}
+			if err := client.AddReverse(remote, local); err != nil {
+				log.Fatalf("Invalid reverse forward: %v", err)
+			}
+		}
+		client.SetSOCKS5(*socks5)
+		client.SetHTTPProxy(*httpProxy)
+		client.SetTCP(*useTCP)
+		if err := client.SetDoHMethod(*dohMethod); err != nil {
+			log.Fatalf("Invalid DoH method: %v", err)
+		}
+		if *tlsCA != "" {
+			if err := client.SetTLSRootCA(*tlsCA); err != nil {
+				log.Fatalf("Failed to load TLS certificates: %v", err)
+			}
+		}
+		if err := client.SetCodec(*codec); err != nil {
+			log.Fatalf("Invalid codec: %v", err)
+		}
+		if err := client.SetRecordType(*recordType); err != nil {
+			log.Fatalf("Invalid record type: %v", err)
+		}
+		if key != nil {
+			client.SetPSK(key)
+		}
+		if identity != nil || *serverKey != "" {
+			if identity == nil || *serverKey == "" {
+				log.Fatalf("-key and -server-key must be used together")
+			}
+			if err := client.SetIdentity(identity, *serverKey); err != nil {
+				log.Fatalf("Invalid server key: %v", err)
+			}
+		}
+		if err := client.SetDomain(*domain); err != nil {
+			log.Fatalf("Invalid domain: %v", err)
+		}
 		log.Printf("Starting DNS tunnel client:")
-		log.Printf("  TCP listening on: %s", *clientListen)
-		log.Printf("  Tunneling to DNS server: %s", *clientDest)
+		if *clientListen != "" {
+			log.Printf("  TCP listening on: %s", *clientListen)
+		}
+		for _, spec := range forwards {
+			log.Printf("  Forwarding: %s", spec)
+		}
+		for _, spec := range reverses {
+			log.Printf("  Reverse forwarding: %s", spec)
+		}
+		for _, spec := range udpForwards {
+			log.Printf("  UDP forwarding: %s", spec)
+		}
+		if *socks5 != "" {
+			log.Printf("  SOCKS5 listening on: %s", *socks5)
+		}
+		if *httpProxy != "" {
+			log.Printf("  HTTP proxy listening on: %s", *httpProxy)
+		}
+		log.Printf("  Tunneling through DNS servers: %s", *clientDest)
 		log.Fatal(client.Start())
 	}
 
@@ -94,3 +362,65 @@ func main() {
 	flag.Usage()
 	os.Exit(1)
 }
+
+// loadPSK returns the pre-shared key given on the command line or in a file,
+// or nil when neither is set
+func loadPSK(psk, pskFile string) ([]byte, error) {
+	if psk != "" && pskFile != "" {
+		return nil, fmt.Errorf("use either -psk or -psk-file, not both")
+	}
+	if pskFile != "" {
+		data, err := os.ReadFile(pskFile)
+		if err != nil {
+			return nil, err
+		}
+		psk = strings.TrimSpace(string(data))
+		if psk == "" {
+			return nil, fmt.Errorf("%s is empty", pskFile)
+		}
+	}
+	if psk == "" {
+		return nil, nil
+	}
+	return []byte(psk), nil
+}
+
+// zoneRecords builds the authoritative records from the -zone-* flags
+func zoneRecords(nameservers, addresses, mailbox string) (tunnel.ZoneRecords, error) {
+	records := tunnel.ZoneRecords{
+		Nameservers: splitList(nameservers),
+		Mailbox:     mailbox,
+	}
+	for _, addr := range splitList(addresses) {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return records, fmt.Errorf("invalid address %q", addr)
+		}
+		records.Addresses = append(records.Addresses, ip)
+	}
+	return records, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// listFlag collects a flag that may be repeated, each value also being a
+// comma-separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, splitList(value)...)
+	return nil
+}
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultZoneTTL = 300
+
+// ZoneRecords are the records the server answers authoritatively for the
+// tunnel domain itself, so resolvers keep delegating to it
+type ZoneRecords struct {
+	Nameservers []string // Nameserver host names; defaults to ns.<domain>
+	Addresses   []net.IP // A/AAAA records for the apex and in-zone nameservers
+	Mailbox     string   // SOA responsible mailbox; defaults to hostmaster.<domain>
+	TTL         uint32   // Defaults to 300 seconds
+}
+
+// authority answers the non-tunnel questions about the tunnel zone: SOA and
+// NS at the apex, addresses for the apex and its nameservers, and NXDOMAIN
+// for anything else that is not tunnel traffic
+type authority struct {
+	zone        string
+	nameservers []string
+	addresses   []net.IP
+	mailbox     string
+	ttl         uint32
+	serial      uint32
+}
+
+func newAuthority(domain string, records ZoneRecords) *authority {
+	a := &authority{
+		zone:      dns.Fqdn(domain),
+		addresses: records.Addresses,
+		mailbox:   dns.Fqdn(records.Mailbox),
+		ttl:       records.TTL,
+		serial:    uint32(time.Now().Unix()),
+	}
+
+	for _, ns := range records.Nameservers {
+		a.nameservers = append(a.nameservers, dns.Fqdn(strings.ToLower(ns)))
+	}
+	if len(a.nameservers) == 0 {
+		a.nameservers = []string{"ns." + a.zone}
+	}
+	if records.Mailbox == "" {
+		a.mailbox = "hostmaster." + a.zone
+	}
+	if a.ttl == 0 {
+		a.ttl = defaultZoneTTL
+	}
+	return a
+}
+
+// isApex reports whether name is the zone itself
+func (a *authority) isApex(name string) bool {
+	return strings.EqualFold(dns.Fqdn(name), a.zone)
+}
+
+// isNameserver reports whether name is one of the zone's own nameservers
+func (a *authority) isNameserver(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, ns := range a.nameservers {
+		if ns == name {
+			return true
+		}
+	}
+	return false
+}
+
+// answer fills msg for a question about the apex or a nameserver and
+// reports whether it did
+func (a *authority) answer(msg *dns.Msg, question dns.Question) bool {
+	switch {
+	case a.isApex(question.Name):
+		switch question.Qtype {
+		case dns.TypeSOA:
+			msg.Answer = append(msg.Answer, a.soa())
+		case dns.TypeNS:
+			msg.Answer = append(msg.Answer, a.ns(question.Name)...)
+			msg.Extra = append(msg.Extra, a.glue()...)
+		case dns.TypeANY:
+			msg.Answer = append(msg.Answer, a.soa())
+			msg.Answer = append(msg.Answer, a.ns(question.Name)...)
+			msg.Answer = append(msg.Answer, a.addressRecords(question.Name, dns.TypeANY)...)
+		default:
+			msg.Answer = append(msg.Answer, a.addressRecords(question.Name, question.Qtype)...)
+		}
+	case a.isNameserver(question.Name):
+		msg.Answer = append(msg.Answer, a.addressRecords(question.Name, question.Qtype)...)
+	default:
+		return false
+	}
+
+	msg.Authoritative = true
+	if len(msg.Answer) == 0 {
+		// The name exists but has no records of this type
+		a.nodata(msg)
+	}
+	return true
+}
+
+// nxdomain marks msg as an authoritative denial for a name in the zone
+func (a *authority) nxdomain(msg *dns.Msg) {
+	msg.Authoritative = true
+	msg.Rcode = dns.RcodeNameError
+	msg.Ns = append(msg.Ns, a.soa())
+}
+
+// nodata marks msg as an authoritative empty answer for a name in the zone
+func (a *authority) nodata(msg *dns.Msg) {
+	msg.Authoritative = true
+	msg.Ns = append(msg.Ns, a.soa())
+}
+
+func (a *authority) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: a.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: a.ttl},
+		Ns:      a.nameservers[0],
+		Mbox:    a.mailbox,
+		Serial:  a.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  0, // Never cache denials; tunnel names are unique anyway
+	}
+}
+
+func (a *authority) ns(name string) []dns.RR {
+	var records []dns.RR
+	for _, ns := range a.nameservers {
+		records = append(records, &dns.NS{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: a.ttl},
+			Ns:  ns,
+		})
+	}
+	return records
+}
+
+// glue returns address records for the nameservers inside the zone
+func (a *authority) glue() []dns.RR {
+	var records []dns.RR
+	for _, ns := range a.nameservers {
+		if dns.IsSubDomain(a.zone, ns) {
+			records = append(records, a.addressRecords(ns, dns.TypeANY)...)
+		}
+	}
+	return records
+}
+
+// addressRecords returns the configured A and/or AAAA records for name
+func (a *authority) addressRecords(name string, qtype uint16) []dns.RR {
+	var records []dns.RR
+	for _, ip := range a.addresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype == dns.TypeA || qtype == dns.TypeANY {
+				records = append(records, &dns.A{
+					Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: a.ttl},
+					A:   ip4,
+				})
+			}
+		} else if qtype == dns.TypeAAAA || qtype == dns.TypeANY {
+			records = append(records, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: a.ttl},
+				AAAA: ip,
+			})
+		}
+	}
+	return records
+}
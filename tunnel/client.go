@@ -25,11 +25,19 @@ SOFTWARE.
 package tunnel
 
 import (
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -38,64 +46,323 @@ import (
 // DNSClient represents a DNS tunnel client
 type DNSClient struct {
 	listenAddr string
+	socksAddr  string
+	httpAddr   string
+	forwards   []forward
+	reverses   []reverseForward
+	udp        []udpForward
 	dnsServer  string
-	sessionID  string
-	tld        string
-	dnsClient  *dns.Client
+	domain     string
+	resolvers  *resolverPool
+	windowSize int
+	psk        []byte
+	identity   *KeyPair
+	serverKey  *ecdh.PublicKey
 	debug      bool
+
+	// Codec for query names and answer type for downstream data; nil and
+	// zero have probing pick what the resolver path preserves
+	codec      Codec
+	recordType uint16
+
+	// Profile of the resolver path, probed when the first session starts
+	pathMu sync.Mutex
+	path   *pathProfile
+
+	// Session that new connections are opened as streams on
+	sessionMu sync.Mutex
+	session   *clientSession
+}
+
+// forward is a local listener whose connections go to one of the server's
+// named mappings
+type forward struct {
+	listenAddr string
+	mapping    string
+}
+
+// reverseForward is a server listener whose connections are carried back
+// and dialed on the client's network
+type reverseForward struct {
+	remoteAddr string
+	localAddr  string
 }
 
 // NewDNSClient creates a new DNS tunnel client
 func NewDNSClient(listenAddr, dnsServer string, debug bool) (*DNSClient, error) {
-	sessionID := generateSessionID()
-
-	dnsClient := &dns.Client{
-		Net:          "udp",
-		ReadTimeout:  2 * time.Second,
-		WriteTimeout: 2 * time.Second,
+	servers, err := parseResolvers(dnsServer)
+	if err != nil {
+		return nil, err
 	}
 
 	return &DNSClient{
 		listenAddr: listenAddr,
 		dnsServer:  dnsServer,
-		sessionID:  sessionID,
-		tld:        defaultTLD,
-		dnsClient:  dnsClient,
+		domain:     defaultTLD,
+		resolvers:  newResolverPool(servers, debug),
+		windowSize: defaultWindowSize,
 		debug:      debug,
 	}, nil
 }
 
-// Add a new method to reset client state
-func (c *DNSClient) resetState() {
-	// Generate new session ID for new connections
-	c.sessionID = generateSessionID()
+// SetSOCKS5 also accepts SOCKS5 clients on addr, such as "127.0.0.1:1080".
+// Each CONNECT is carried as a stream to its target, which the server
+// resolves and dials.
+func (c *DNSClient) SetSOCKS5(addr string) {
+	c.socksAddr = addr
+}
 
-	if c.debug {
-		log.Printf("Reset client state with new session ID: %s", c.sessionID)
+// SetHTTPProxy also accepts HTTP proxy clients on addr, such as
+// "127.0.0.1:8080". CONNECT requests and absolute-URI requests are carried
+// as streams to the host they name.
+func (c *DNSClient) SetHTTPProxy(addr string) {
+	c.httpAddr = addr
+}
+
+// AddForward also accepts connections on listenAddr and carries each to
+// the server's mapping of that name, such as "ssh"
+func (c *DNSClient) AddForward(listenAddr, mapping string) error {
+	if !isMappingName(mapping) {
+		return fmt.Errorf("invalid mapping name %q", mapping)
 	}
+	c.forwards = append(c.forwards, forward{listenAddr, mapping})
+	return nil
 }
 
-// Update Start method to handle multiple connections
+// AddReverse asks the server to listen on remoteAddr and carries each
+// connection it accepts back to be dialed to localAddr, like ssh -R. The
+// server must allow reverse forwarding.
+func (c *DNSClient) AddReverse(remoteAddr, localAddr string) error {
+	if _, _, err := net.SplitHostPort(remoteAddr); err != nil {
+		return fmt.Errorf("invalid server address %q: %v", remoteAddr, err)
+	}
+	if _, _, err := net.SplitHostPort(localAddr); err != nil {
+		return fmt.Errorf("invalid local address %q: %v", localAddr, err)
+	}
+	c.reverses = append(c.reverses, reverseForward{remoteAddr, localAddr})
+	return nil
+}
+
+// AddUDPForward also accepts datagrams on the UDP address listenAddr and
+// carries them to target, a UDP host:port the server sends them to, with
+// replies returned to the sender
+func (c *DNSClient) AddUDPForward(listenAddr, target string) error {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return fmt.Errorf("invalid UDP target %q: %v", target, err)
+	}
+	c.udp = append(c.udp, udpForward{listenAddr, target})
+	return nil
+}
+
+// SetWindowSize sets how many queries the session may keep in flight.
+// The congestion window grows toward this limit and shrinks on loss.
+func (c *DNSClient) SetWindowSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if n > maxReorderWindow {
+		n = maxReorderWindow
+	}
+	c.windowSize = n
+}
+
+// SetDomain makes queries end in a zone delegated to the tunnel server,
+// such as "t.example.com", so they can travel through recursive resolvers.
+// The zone must leave room for data in the shortest names probed, with
+// the encryption set up by SetPSK or SetIdentity, so call those first.
+func (c *DNSClient) SetDomain(domain string) error {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return nil
+	}
+	shortest := probeNameLengths[len(probeNameLengths)-1]
+	if payloadSize(codecBase32, domain, shortest)-c.frameOverhead() < 1 {
+		return fmt.Errorf("zone %q is too long to leave room for data in %d-byte names", domain, shortest)
+	}
+	c.domain = domain
+	return nil
+}
+
+// SetTCP sends every query over TCP instead of UDP, for networks that
+// restrict UDP. Truncated UDP answers are retried over TCP either way.
+// It has no effect on DNS over HTTPS or TLS resolvers.
+func (c *DNSClient) SetTCP(enabled bool) {
+	for _, r := range c.resolvers.all {
+		if t, ok := r.transport.(*dnsTransport); ok {
+			t.forceTCP = enabled
+		}
+	}
+}
+
+// SetTLSRootCA verifies DNS over TLS and HTTPS resolvers against the
+// certificates in a PEM file, such as a tunnel server's self-signed
+// certificate, instead of the system roots
+func (c *DNSClient) SetTLSRootCA(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", file)
+	}
+
+	for _, r := range c.resolvers.all {
+		switch t := r.transport.(type) {
+		case *dnsTransport:
+			if t.tcp.TLSConfig != nil {
+				t.tcp.TLSConfig.RootCAs = roots
+			}
+		case *dohTransport:
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+			t.client.Transport = transport
+		}
+	}
+	return nil
+}
+
+// SetDoHMethod chooses how queries reach a DNS over HTTPS resolver: "POST"
+// sends them in the request body and "GET" in the URL, which caching
+// proxies handle better
+func (c *DNSClient) SetDoHMethod(method string) error {
+	var get bool
+	switch strings.ToUpper(method) {
+	case "", http.MethodPost:
+	case http.MethodGet:
+		get = true
+	default:
+		return fmt.Errorf("unsupported DoH method %q", method)
+	}
+
+	for _, r := range c.resolvers.all {
+		if t, ok := r.transport.(*dohTransport); ok {
+			t.get = get
+		}
+	}
+	return nil
+}
+
+// SetRecordType chooses the answer type downstream data comes back in:
+// TXT, NULL, CNAME, MX, SRV, A, AAAA or PRIVATE. "auto" probes the resolver
+// path for the densest type it passes.
+func (c *DNSClient) SetRecordType(name string) error {
+	if name == "" || name == "auto" {
+		c.recordType = 0
+		return nil
+	}
+
+	qtype, err := parseRecordType(name)
+	if err != nil {
+		return err
+	}
+	c.recordType = qtype
+	return nil
+}
+
+// SetCodec fixes the codec used for query names: "base32", "base36",
+// "base64" or "raw". "auto" probes the resolver path for the densest codec it preserves.
+func (c *DNSClient) SetCodec(name string) error {
+	if name == "" || name == "auto" {
+		c.codec = nil
+		return nil
+	}
+
+	codec, err := codecByName(name)
+	if err != nil {
+		return err
+	}
+	c.codec = codec
+	return nil
+}
+
+// chunkSize returns how many payload bytes fit in one data frame on path
+// once the frame header and any encryption overhead are accounted for
+func (c *DNSClient) chunkSize(path *pathProfile) int {
+	return payloadSize(path.codec, c.domain, path.nameLength) - c.frameOverhead()
+}
+
+// frameOverhead returns how many bytes of a query's payload are taken by
+// the frame header and any encryption
+func (c *DNSClient) frameOverhead() int {
+	if c.psk != nil || c.identity != nil {
+		return frameHeaderSize + envelopeOverhead
+	}
+	return frameHeaderSize
+}
+
+// SetPSK enables authenticated encryption of every frame with a key shared
+// with the server. The server rejects sessions whose client clock is more
+// than ten minutes off its own.
+func (c *DNSClient) SetPSK(psk []byte) {
+	c.psk = psk
+}
+
+// SetIdentity makes every session start with a handshake that proves this
+// client's key to the server and derives fresh session keys. serverKey is
+// the server's base64 public key.
+func (c *DNSClient) SetIdentity(identity *KeyPair, serverKey string) error {
+	key, err := parsePublicKey(serverKey)
+	if err != nil {
+		return err
+	}
+	c.identity = identity
+	c.serverKey = key
+	return nil
+}
+
+// Start accepts local connections and carries each as a stream on the
+// current tunnel session, on the port forwarding, named mapping, SOCKS5
+// and HTTP proxy listeners, whichever are set, along with datagrams on any
+// UDP forwards, and keeps any reverse forwards listening on the server
 func (c *DNSClient) Start() error {
-	listener, err := net.Listen("tcp", c.listenAddr)
+	errs := make(chan error, 3+len(c.forwards)+len(c.udp)+len(c.reverses))
+	for _, r := range c.reverses {
+		go func() { errs <- c.keepReverse(r) }()
+	}
+	listeners := len(c.reverses)
+	if c.listenAddr != "" {
+		listeners++
+		go func() { errs <- c.serve(c.listenAddr, c.handleConnection) }()
+	}
+	for _, f := range c.udp {
+		listeners++
+		go func() { errs <- c.serveUDP(f) }()
+	}
+	for _, f := range c.forwards {
+		listeners++
+		go func() {
+			errs <- c.serve(f.listenAddr, func(conn net.Conn) { c.forwardConnection(conn, f.mapping) })
+		}()
+	}
+	if c.socksAddr != "" {
+		listeners++
+		go func() { errs <- c.serve(c.socksAddr, c.handleSOCKS5) }()
+	}
+	if c.httpAddr != "" {
+		listeners++
+		go func() { errs <- c.serve(c.httpAddr, c.handleHTTPProxy) }()
+	}
+	if listeners == 0 {
+		return fmt.Errorf("no listen address set")
+	}
+	return <-errs
+}
+
+// serve accepts connections on addr and hands each to handle
+func (c *DNSClient) serve(addr string, handle func(net.Conn)) error {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to start TCP listener: %v", err)
 	}
 	defer listener.Close()
 
 	if c.debug {
-		log.Printf("TCP listener started on %s", c.listenAddr)
+		log.Printf("TCP listener started on %s", addr)
 		log.Printf("Tunneling to DNS server at %s", c.dnsServer)
 	}
 
 	for {
-		// Reset state for each new connection
-		c.resetState()
-
-		if c.debug {
-			log.Printf("Waiting for new connection with session ID: %s", c.sessionID)
-		}
-
 		conn, err := listener.Accept()
 		if err != nil {
 			if c.debug {
@@ -105,239 +372,708 @@ func (c *DNSClient) Start() error {
 		}
 
 		if c.debug {
-			log.Printf("New connection accepted, handling with session ID: %s", c.sessionID)
+			log.Printf("New connection accepted from %s", conn.RemoteAddr())
 		}
 
 		// Handle connection in goroutine
 		go func() {
-			c.handleConnection(conn)
+			handle(conn)
 			if c.debug {
-				log.Printf("Connection handled, ready for next connection")
+				log.Printf("Connection from %s handled", conn.RemoteAddr())
 			}
 		}()
 	}
 }
 
-// Update handleConnection to be more robust
-func (c *DNSClient) handleConnection(conn net.Conn) {
-	defer conn.Close()
-
-	done := make(chan struct{})
-	defer close(done)
-
-	errChan := make(chan error, 2)
+// keepReverse keeps the server listening for a reverse forward, asking
+// again whenever the listener or its session goes away. Failed requests
+// are retried with exponential backoff, but a listener the server's policy
+// refuses is given up on with an error. The listener's stream keeps the
+// session from closing for being idle.
+func (c *DNSClient) keepReverse(r reverseForward) error {
+	delay := reverseRetryDelay
+	backoff := func() {
+		time.Sleep(delay)
+		delay = min(2*delay, maxReverseRetryDelay)
+	}
 
-	// Start read goroutine
-	go func() {
-		buffer := make([]byte, maxChunkSize)
-		sequence := uint16(0)
-		for {
-			select {
-			case <-done:
-				return
-			default:
-				n, err := conn.Read(buffer)
-				if err != nil {
-					if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
-						if c.debug {
-							log.Printf("Error reading from connection: %v", err)
-						}
-					}
-					errChan <- err
-					return
-				}
-				if n > 0 {
-					if err := c.sendChunk(buffer[:n], sequence); err != nil {
-						if c.debug {
-							log.Printf("Error sending chunk: %v", err)
-						}
-						errChan <- err
-						return
-					}
-					sequence++
-				}
+	for {
+		listener, err := c.openListener(r.remoteAddr)
+		if err != nil {
+			if c.debug || delay == reverseRetryDelay {
+				log.Printf("Failed to request listener on %s: %v", r.remoteAddr, err)
 			}
+			backoff()
+			continue
 		}
-	}()
 
-	// Start poll goroutine
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			default:
-				data, err := c.pollForData()
-				if err != nil {
-					if c.debug {
-						log.Printf("Poll error: %v", err)
-					}
-					errChan <- err
-					return
-				}
-				if data != nil {
-					if string(data) == "CLOSED" {
-						if c.debug {
-							log.Printf("Server indicated session closed")
-						}
-						errChan <- fmt.Errorf("session closed by server")
-						return
-					}
-					if len(data) > 0 && string(data) != "EMPTY" {
-						if _, err := conn.Write(data); err != nil {
-							if c.debug {
-								log.Printf("Error writing to connection: %v", err)
-							}
-							errChan <- err
-							return
-						}
-						if c.debug {
-							log.Printf("Wrote %d bytes from poll to local connection", len(data))
-						}
-					}
-				}
-				time.Sleep(pollDelay)
+		select {
+		case <-listener.ready:
+			log.Printf("Server listening on %s, forwarding to %s", r.remoteAddr, r.localAddr)
+			<-listener.done
+			log.Printf("Server stopped listening on %s", r.remoteAddr)
+			delay = reverseRetryDelay
+			time.Sleep(delay)
+		case <-listener.done:
+			listener.mux.mu.Lock()
+			reason := listener.reason
+			listener.mux.mu.Unlock()
+			if reason == resetNotAllowed {
+				return fmt.Errorf("server does not allow listening on %s", r.remoteAddr)
+			}
+			if c.debug || delay == reverseRetryDelay {
+				log.Printf("Server could not listen on %s", r.remoteAddr)
 			}
+			backoff()
 		}
-	}()
+	}
+}
 
-	// Wait for either an error or done signal
-	select {
-	case err := <-errChan:
-		if c.debug {
-			log.Printf("Session ended: %v", err)
+// openListener asks the server to listen on addr over the current session
+func (c *DNSClient) openListener(addr string) (*stream, error) {
+	for {
+		session, err := c.currentSession()
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up session: %v", err)
+		}
+
+		listener, err := session.mux.requestListen(addr)
+		if err != errMuxClosed {
+			return listener, err
+		}
+	}
+}
+
+// acceptReverse dials the local address for a connection the server
+// accepted on a reverse forward's listener
+func (c *DNSClient) acceptReverse(remoteAddr string) (net.Conn, error) {
+	for _, r := range c.reverses {
+		if r.remoteAddr != remoteAddr {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", r.localAddr, 30*time.Second)
+		if err != nil {
+			log.Printf("Reverse forward from %s failed: %v", remoteAddr, err)
+			return nil, dialRefusal(err)
+		}
+		return conn, nil
+	}
+	return nil, &refusal{resetNotAllowed, fmt.Errorf("no reverse forward from %s", remoteAddr)}
+}
+
+// handleConnection carries a local connection as a stream to the server's
+// destination and returns once the stream has finished
+func (c *DNSClient) handleConnection(conn net.Conn) {
+	c.forwardConnection(conn, "")
+}
+
+// forwardConnection carries a local connection as a stream to target, a
+// mapping name or empty for the server's destination, and returns once the
+// stream has finished
+func (c *DNSClient) forwardConnection(conn net.Conn, target string) {
+	stream, err := c.openStream(target)
+	if err != nil {
+		log.Printf("Failed to open stream: %v", err)
+		conn.Close()
+		return
+	}
+	if stream.attach(conn) {
+		<-stream.done
+	}
+}
+
+// openStream opens a stream to target on the current session. A session
+// may close for being idle just as the stream is opened, in which case the
+// next attempt starts a new one.
+func (c *DNSClient) openStream(target string) (*stream, error) {
+	for {
+		session, err := c.currentSession()
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up session: %v", err)
+		}
+
+		stream, err := session.mux.open(target)
+		if err != errMuxClosed {
+			return stream, err
 		}
-	case <-done:
 	}
 }
 
-// sendChunk sends a chunk of data through DNS
-func (c *DNSClient) sendChunk(chunk []byte, sequence uint16) error {
-	// Split large chunks into smaller ones
-	maxChunkSize := 100 // Reduced chunk size
+// connectStream opens a stream to target and waits until the server has
+// connected to it. When it could not, the error is a refusal with the
+// reason the server gave.
+func (c *DNSClient) connectStream(target string) (*stream, error) {
+	stream, err := c.openStream(target)
+	if err != nil {
+		return nil, err
+	}
 
-	chunks := splitDataIntoChunks(chunk, maxChunkSize)
+	select {
+	case <-stream.ready:
+		return stream, nil
+	case <-stream.done:
+		stream.mux.mu.Lock()
+		reason := stream.reason
+		stream.mux.mu.Unlock()
+		return nil, &refusal{reason, errors.New(resetReasonText(reason))}
+	}
+}
 
-	for i, subChunk := range chunks {
-		encodedData := encodeDNSSafe(subChunk)
+// currentSession returns the session new streams are opened on, starting
+// one when none is running. Sessions are created under a lock so that
+// connections arriving together share one.
+func (c *DNSClient) currentSession() (*clientSession, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
 
-		// Construct FQDN
-		fqdn := fmt.Sprintf("%s.%04x.%s.%s",
-			encodedData,
-			sequence+uint16(i),
-			c.sessionID,
-			c.tld)
+	if c.session != nil && !c.session.closed() {
+		return c.session, nil
+	}
 
-		if c.debug {
-			log.Printf("=== Sending DNS Query ===")
-			log.Printf("To: %s", c.dnsServer)
-			log.Printf("FQDN: %s", fqdn)
-			log.Printf("Sequence: %d", sequence+uint16(i))
-			log.Printf("Chunk size: %d", len(subChunk))
+	session, err := newClientSession(c, generateSessionID(), newMux(true, c.acceptReverse, c.debug))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.identity != nil {
+		if err := session.handshake(); err != nil {
+			return nil, fmt.Errorf("handshake failed: %v", err)
+		}
+	}
+
+	if c.debug {
+		log.Printf("Started session %08x", session.id)
+	}
+
+	go session.readLoop()
+	go session.pollLoop()
+	go session.run()
+
+	c.session = session
+	return session, nil
+}
+
+// run ends the session once it has carried no streams for sessionLinger,
+// then lets the server release it
+func (s *clientSession) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for !s.closed() {
+		select {
+		case <-s.done:
+		case <-ticker.C:
+			if s.mux.closeIfIdle(sessionLinger) {
+				s.fail(fmt.Errorf("idle for %v", sessionLinger))
+			}
 		}
+	}
+
+	if s.client.debug {
+		log.Printf("Session %08x ended: %v", s.id, s.err)
+	}
+
+	if _, err := s.sendQuery(&frame{Type: frameFin, Session: s.id}); err != nil && s.client.debug {
+		log.Printf("Failed to send FIN: %v", err)
+	}
+}
+
+// clientSession carries the streams of a mux over the tunnel, keeping
+// several data and poll queries in flight within a congestion window
+type clientSession struct {
+	client *DNSClient
+	id     uint32
+	mux    *mux
+	window *congestionWindow
+	cipher *sessionCipher
+	path   *pathProfile
 
-		_, err := c.sendQuery(fqdn)
+	// Upstream segments; cond is signaled when acknowledgements free space
+	// or poll slots open up
+	mu   sync.Mutex
+	cond *sync.Cond
+	send *sendWindow
+
+	// Poll scheduling, guarded by mu
+	pollSeq    uint16
+	polling    int
+	pollTarget int
+	failures   int
+
+	// Downstream reordering; recvMu also serializes writes to the mux
+	recvMu sync.Mutex
+	recv   *recvWindow
+
+	done    chan struct{}
+	errOnce sync.Once
+	err     error
+}
+
+func newClientSession(c *DNSClient, id uint32, m *mux) (*clientSession, error) {
+	session := &clientSession{
+		client:     c,
+		id:         id,
+		mux:        m,
+		window:     newCongestionWindow(c.windowSize),
+		send:       newSendWindow(),
+		recv:       newRecvWindow(),
+		pollTarget: 1,
+		done:       make(chan struct{}),
+	}
+	session.cond = sync.NewCond(&session.mu)
+
+	path, err := c.sessionPath()
+	if err != nil {
+		return nil, err
+	}
+	session.path = path
+
+	// With an identity the cipher comes from the handshake instead
+	if c.psk != nil && c.identity == nil {
+		cipher, err := newPSKCipher(c.psk, id, newPSKSalt(), true)
 		if err != nil {
-			return fmt.Errorf("failed to send chunk %d: %v", sequence+uint16(i), err)
+			return nil, err
 		}
+		session.cipher = cipher
+	}
+	return session, nil
+}
+
+// handshake authenticates to the server and installs the session keys
+func (s *clientSession) handshake() error {
+	hs, msg, err := newClientHandshake(s.client.identity, s.client.serverKey, s.id, s.client.psk)
+	if err != nil {
+		return err
 	}
 
+	response, err := s.sendQuery(&frame{Type: frameHandshake, Session: s.id, Payload: msg})
+	if err != nil {
+		return err
+	}
+	if response.Type == frameRst {
+		return fmt.Errorf("server refused the handshake")
+	}
+	if response.Type != frameHandshake {
+		return fmt.Errorf("unexpected %s frame during handshake", frameTypeName(response.Type))
+	}
+
+	cipher, err := hs.finish(response.Payload)
+	if err != nil {
+		return err
+	}
+	s.cipher = cipher
+
+	if s.client.debug {
+		log.Printf("Handshake complete for session %08x", s.id)
+	}
 	return nil
 }
 
-// sendQuery sends a DNS query and returns the response
-func (c *DNSClient) sendQuery(fqdn string) ([]byte, error) {
-	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeTXT)
-	msg.RecursionDesired = true
+// fail ends the session, recording the first reason given
+func (s *clientSession) fail(err error) {
+	s.errOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.window.close()
+		s.mux.Close()
 
-	// Set EDNS0 options for larger responses
-	opt := new(dns.OPT)
-	opt.Hdr.Name = "."
-	opt.Hdr.Rrtype = dns.TypeOPT
-	opt.SetUDPSize(4096)
-	msg.Extra = append(msg.Extra, opt)
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if c.debug {
-			log.Printf("Attempt %d of %d", attempt, maxRetries)
-		}
+func (s *clientSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
 
-		r, _, err := c.dnsClient.Exchange(msg, c.dnsServer)
+// ack returns the highest contiguous downstream sequence written locally
+func (s *clientSession) ack() uint16 {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	return s.recv.ack()
+}
+
+// readLoop reads the mux's records and queues their bytes as segments,
+// waiting whenever the send window is full
+func (s *clientSession) readLoop() {
+	// Each read fills at most one query name on the session's path
+	buffer := make([]byte, s.client.chunkSize(s.path))
+	for {
+		n, err := s.mux.Read(buffer)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+
+			s.mu.Lock()
+			for s.send.len() >= s.client.windowSize && !s.closed() {
+				s.cond.Wait()
+			}
+			seg := s.send.add(data)
+			s.mu.Unlock()
+
+			if s.closed() {
+				return
+			}
+			go s.transmit(seg)
+		}
 		if err != nil {
-			if strings.Contains(err.Error(), "i/o timeout") {
-				if c.debug {
-					log.Printf("Query failed: %v, retrying...", err)
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				if s.client.debug {
+					log.Printf("Error reading from connection: %v", err)
 				}
-				time.Sleep(retryDelay)
-				continue
 			}
-			return nil, err
+
+			// Give queued data a chance to reach the server before closing
+			s.mu.Lock()
+			for s.send.len() > 0 && !s.closed() {
+				s.cond.Wait()
+			}
+			s.mu.Unlock()
+
+			s.fail(err)
+			return
 		}
+	}
+}
 
-		if r.Rcode != dns.RcodeSuccess {
-			if c.debug {
-				log.Printf("Query returned error code %d, retrying...", r.Rcode)
+// transmit sends one upstream segment, retransmitting until the server has
+// either acknowledged it or confirmed it is holding it out of order
+func (s *clientSession) transmit(seg *segment) {
+	for {
+		if !s.window.acquire() {
+			return
+		}
+
+		f := &frame{
+			Type:    frameData,
+			Session: s.id,
+			Seq:     seg.seq,
+			Ack:     s.ack(),
+			Payload: seg.data,
+		}
+
+		if s.client.debug {
+			log.Printf("=== Sending DNS Query ===")
+			log.Printf("To: %s", s.client.dnsServer)
+			log.Printf("Sequence: %d", seg.seq)
+			log.Printf("Chunk size: %d", len(seg.data))
+		}
+
+		response, rtt, err := s.exchange(f, s.window.timeout())
+		s.window.release()
+
+		if err != nil {
+			if s.client.debug {
+				log.Printf("Failed to send chunk %d: %v", seg.seq, err)
+			}
+			s.window.onLoss()
+			if !s.retransmit(seg) {
+				return
 			}
-			time.Sleep(retryDelay)
 			continue
 		}
+		s.window.onSuccess(rtt)
 
-		if len(r.Answer) > 0 {
-			if txt, ok := r.Answer[0].(*dns.TXT); ok {
-				responseText := strings.Join(txt.Txt, "")
-				if responseText == "EMPTY" {
-					return nil, nil
-				}
+		if !s.handleControl(response) {
+			return
+		}
 
-				decodedResponse, err := decodeDNSSafe(responseText)
-				if err != nil {
-					if c.debug {
-						log.Printf("Failed to decode response: %v", err)
-					}
-					return nil, err
-				}
-				return decodedResponse, nil
+		s.mu.Lock()
+		s.send.acknowledge(response.Ack)
+		if response.Flags&flagReceived != 0 && response.Seq == seg.seq {
+			seg.received = true
+		}
+		delivered := seg.received || !seqLess(response.Ack, seg.seq)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		if delivered {
+			return
+		}
+
+		if s.client.debug {
+			log.Printf("Chunk %d not accepted (ack %d), retransmitting", seg.seq, response.Ack)
+		}
+		if !s.retransmit(seg) {
+			return
+		}
+		time.Sleep(retryDelay)
+	}
+}
+
+// retransmit counts another attempt at seg and fails the session once the
+// server has stayed unreachable for too long
+func (s *clientSession) retransmit(seg *segment) bool {
+	s.mu.Lock()
+	seg.retries++
+	retries := seg.retries
+	s.mu.Unlock()
+
+	if retries > maxRetransmits {
+		s.fail(fmt.Errorf("chunk %d was never acknowledged", seg.seq))
+		return false
+	}
+	return true
+}
+
+// handleControl ends the session on FIN or RST, returning false if it did
+func (s *clientSession) handleControl(response *frame) bool {
+	if response.Type != frameFin && response.Type != frameRst {
+		return true
+	}
+
+	if s.client.debug {
+		log.Printf("Server indicated session closed (%s)", frameTypeName(response.Type))
+	}
+
+	// Let any in-progress local write finish first
+	s.recvMu.Lock()
+	s.fail(fmt.Errorf("session closed by server"))
+	s.recvMu.Unlock()
+	return false
+}
+
+// pollLoop keeps polls in flight for downstream data. A single poll runs
+// while the session is idle; the number grows while polls return data.
+func (s *clientSession) pollLoop() {
+	for {
+		s.mu.Lock()
+		for s.polling >= s.pollTarget && !s.closed() {
+			s.cond.Wait()
+		}
+		if s.closed() {
+			s.mu.Unlock()
+			return
+		}
+		s.polling++
+		pollSeq := s.pollSeq
+		s.pollSeq++
+		s.mu.Unlock()
+
+		go s.poll(pollSeq)
+	}
+}
+
+// poll asks the server for downstream data, acknowledging what has already
+// been written locally so the server can replay anything whose answer was lost
+func (s *clientSession) poll(pollSeq uint16) {
+	defer func() {
+		s.mu.Lock()
+		s.polling--
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	if !s.window.acquire() {
+		return
+	}
+
+	f := &frame{
+		Type:    framePoll,
+		Session: s.id,
+		Seq:     pollSeq,
+		Ack:     s.ack(),
+	}
+
+	if s.client.debug {
+		log.Printf("=== Sending Poll Query ===")
+		log.Printf("To: %s", s.client.dnsServer)
+	}
+
+	response, rtt, err := s.exchange(f, s.window.timeout())
+	s.window.release()
+
+	if err != nil {
+		if s.client.debug {
+			log.Printf("Poll error: %v", err)
+		}
+		s.window.onLoss()
+
+		// The server replays unacknowledged data, so a lost poll only
+		// matters if the server stays unreachable
+		s.mu.Lock()
+		s.failures++
+		failures := s.failures
+		s.mu.Unlock()
+
+		if failures > maxRetransmits {
+			s.fail(err)
+		}
+		return
+	}
+	s.window.onSuccess(rtt)
+
+	s.mu.Lock()
+	s.failures = 0
+	s.mu.Unlock()
+
+	if !s.handleControl(response) {
+		return
+	}
+
+	if response.Type != frameData {
+		// Nothing waiting; fall back to a single slow poll
+		s.mu.Lock()
+		s.pollTarget = 1
+		s.mu.Unlock()
+		time.Sleep(pollDelay)
+		return
+	}
+
+	s.recvMu.Lock()
+	ready, _ := s.recv.push(response.Seq, response.Payload)
+	for _, chunk := range ready {
+		if _, err := s.mux.Write(chunk); err != nil {
+			s.recvMu.Unlock()
+			if s.client.debug {
+				log.Printf("Error writing to streams: %v", err)
 			}
+			s.fail(err)
+			return
 		}
+		if s.client.debug {
+			log.Printf("Wrote %d bytes from poll to streams", len(chunk))
+		}
+	}
+	s.recvMu.Unlock()
 
-		return nil, nil
+	// More may be queued; widen polling up to the window
+	s.mu.Lock()
+	if s.pollTarget < s.client.windowSize {
+		s.pollTarget++
 	}
+	s.mu.Unlock()
+}
 
-	return nil, fmt.Errorf("max retries exceeded")
+// rcodeError is a DNS answer whose response code reports an error
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return fmt.Sprintf("query returned error code %d", int(e))
 }
 
-// pollForData polls the server for available data
-func (c *DNSClient) pollForData() ([]byte, error) {
-	fqdn := fmt.Sprintf("AA.ffff.%s.%s", c.sessionID, c.tld)
+// buildQuery wraps a payload in a question for the answer type of path
+func (c *DNSClient) buildQuery(path *pathProfile, payload []byte) *dns.Msg {
+	fqdn := encodeName(path.codec, payload, c.domain)
 
 	if c.debug {
-		log.Printf("=== Sending Poll Query ===")
-		log.Printf("To: %s", c.dnsServer)
 		log.Printf("FQDN: %s", fqdn)
 	}
 
-	response, err := c.sendQuery(fqdn)
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(fqdn), path.recordType)
+	msg.RecursionDesired = true
+
+	// Set EDNS0 options for larger responses
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(path.udpSize)
+	msg.Extra = append(msg.Extra, opt)
+
+	return msg
+}
+
+// query sends a payload once and returns the payload of the answer along
+// with the measured round trip time
+func (c *DNSClient) query(path *pathProfile, payload []byte, timeout time.Duration) ([]byte, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	msg := c.buildQuery(path, payload)
+	r, rtt, err := c.resolvers.exchange(ctx, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, rtt, rcodeError(r.Rcode)
+	}
+
+	decodedResponse, err := decodeAnswer(path.recordType, c.domain, r.Answer)
 	if err != nil {
-		return nil, err
+		if c.debug {
+			log.Printf("Failed to decode response: %v", err)
+		}
+		return nil, rtt, err
 	}
+	return decodedResponse, rtt, nil
+}
 
-	if len(response) == 0 || string(response) == "EMPTY" {
-		return nil, nil
+// seal serializes a frame, encrypting it when a pre-shared key is set
+func (s *clientSession) seal(f *frame) ([]byte, error) {
+	if s.cipher == nil {
+		return f.marshal(), nil
 	}
+	return s.cipher.seal(f.marshal())
+}
 
-	return response, nil
+// open authenticates and parses the frame carried in an answer
+func (s *clientSession) open(payload []byte) (*frame, error) {
+	if s.cipher != nil {
+		var err error
+		if payload, err = s.cipher.open(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := parseFrame(payload)
+	if err != nil {
+		return nil, err
+	}
+	if f.Session != s.id {
+		return nil, fmt.Errorf("answer for session %08x, expected %08x", f.Session, s.id)
+	}
+	return f, nil
 }
 
-// sendData sends data through DNS
-func (c *DNSClient) sendData(data []byte) error {
-	if len(data) == 0 {
-		return nil
+// exchange sends a frame once and returns the frame answering it along with
+// the measured round trip time
+func (s *clientSession) exchange(f *frame, timeout time.Duration) (*frame, time.Duration, error) {
+	payload, err := s.seal(f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	answer, rtt, err := s.client.query(s.path, payload, timeout)
+	if err != nil {
+		return nil, rtt, err
 	}
 
-	// Start with sequence 0
-	sequence := uint16(0)
+	response, err := s.open(answer)
+	if err != nil {
+		if s.client.debug {
+			log.Printf("Rejected answer: %v", err)
+		}
+		return nil, rtt, err
+	}
+	return response, rtt, nil
+}
+
+// sendQuery sends a frame as a DNS query, retrying on failure, and returns
+// the frame answering it
+func (s *clientSession) sendQuery(f *frame) (*frame, error) {
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		if s.client.debug {
+			log.Printf("Attempt %d of %d", attempt, maxRetries)
+		}
 
-	// Send data in chunks
-	return c.sendChunk(data, sequence)
+		response, _, err := s.exchange(f, dnsTimeout)
+		if err != nil {
+			if s.client.debug {
+				log.Printf("Query failed: %v, retrying...", err)
+			}
+			time.Sleep(retryDelay)
+			continue
+		}
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("max retries exceeded")
 }
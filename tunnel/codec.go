@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Codec carries frame bytes in the labels of a query name. Denser codecs
+// only survive resolver paths that preserve case or arbitrary octets, so
+// clients probe for them before use.
+type Codec interface {
+	// Name identifies the codec in flags and logs
+	Name() string
+
+	// Encode returns the data as dot-separated labels in presentation
+	// format, escaping octets that are not printable
+	Encode(data []byte) string
+
+	// Decode reverses Encode for labels as they arrive at the server
+	Decode(labels string) ([]byte, error)
+
+	// EncodedLength returns the length on the wire of Encode's output for
+	// n bytes, counting the dots between labels
+	EncodedLength(n int) int
+
+	// tag is the label that precedes the payload so the server knows which
+	// codec to decode with. base32 has none, which keeps it compatible.
+	tag() string
+}
+
+// Codecs in order of preference when negotiating
+var (
+	codecBase32 Codec = base32Codec{}
+	codecBase36 Codec = base36Codec{}
+	codecBase64 Codec = base64Codec{}
+	codecRaw    Codec = rawCodec{}
+
+	negotiableCodecs = []Codec{codecRaw, codecBase64, codecBase36}
+)
+
+// codecByName returns the codec with the given name
+func codecByName(name string) (Codec, error) {
+	for _, codec := range []Codec{codecBase32, codecBase36, codecBase64, codecRaw} {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// codecByTag returns the codec whose tag is label, if any. Tags are digits
+// outside the base32 alphabet so they survive case changes and can never
+// start a base32 name.
+func codecByTag(label string) Codec {
+	for _, codec := range negotiableCodecs {
+		if codec.tag() == label {
+			return codec
+		}
+	}
+	return nil
+}
+
+// splitCodec separates the codec tag from the payload labels of a query
+// name, defaulting to base32 for untagged names
+func splitCodec(labels string) (Codec, string) {
+	if i := strings.IndexByte(labels, '.'); i > 0 {
+		if codec := codecByTag(labels[:i]); codec != nil {
+			return codec, labels[i+1:]
+		}
+	}
+	return codecBase32, labels
+}
+
+// encodeName returns the tagged labels carrying data under domain
+func encodeName(codec Codec, data []byte, domain string) string {
+	if tag := codec.tag(); tag != "" {
+		return fmt.Sprintf("%s.%s.%s", tag, codec.Encode(data), domain)
+	}
+	return fmt.Sprintf("%s.%s", codec.Encode(data), domain)
+}
+
+// maxPayloadSize returns how many bytes fit in a query name under domain
+func maxPayloadSize(codec Codec, domain string) int {
+	return payloadSize(codec, domain, maxNameLength)
+}
+
+// payloadSize returns how many bytes fit in a query name under domain that
+// is at most nameLength long
+func payloadSize(codec Codec, domain string, nameLength int) int {
+	budget := nameLength - len(domain) - 1
+	if tag := codec.tag(); tag != "" {
+		budget -= len(tag) + 1
+	}
+
+	n := 0
+	for codec.EncodedLength(n+1) <= budget {
+		n++
+	}
+	return n
+}
+
+// splitLabels splits s into labels of at most size characters
+func splitLabels(s string, size int) string {
+	var labels []string
+	for i := 0; i < len(s); i += size {
+		end := i + size
+		if end > len(s) {
+			end = len(s)
+		}
+		labels = append(labels, s[i:end])
+	}
+	return strings.Join(labels, ".")
+}
+
+// labelledLength returns the length of chars characters split into labels
+// of at most size characters
+func labelledLength(chars, size int) int {
+	if chars == 0 {
+		return 0
+	}
+	return chars + (chars-1)/size
+}
+
+// base32Codec is the case-insensitive codec every path supports
+type base32Codec struct{}
+
+func (base32Codec) Name() string                         { return "base32" }
+func (base32Codec) tag() string                          { return "" }
+func (base32Codec) Encode(data []byte) string            { return encodeDNSSafe(data) }
+func (base32Codec) Decode(labels string) ([]byte, error) { return decodeDNSSafe(labels) }
+func (base32Codec) EncodedLength(n int) int              { return encodedLength(n) }
+
+// base64Codec uses the URL-safe base64 alphabet in full-length labels. It
+// needs a path that preserves case.
+type base64Codec struct{}
+
+func (base64Codec) Name() string { return "base64" }
+func (base64Codec) tag() string  { return "0" }
+
+func (base64Codec) Encode(data []byte) string {
+	return splitLabels(base64.RawURLEncoding.EncodeToString(data), maxLabelSize)
+}
+
+func (base64Codec) Decode(labels string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.ReplaceAll(labels, ".", ""))
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode error: %v", err)
+	}
+	return decoded, nil
+}
+
+func (base64Codec) EncodedLength(n int) int {
+	return labelledLength(base64.RawURLEncoding.EncodedLen(n), maxLabelSize)
+}
+
+// base36Codec writes the data as one base-36 number of digits and lower-case
+// letters in full-length labels. Like base32 it survives case changes, but
+// it packs more bits into each character and uses longer labels.
+type base36Codec struct{}
+
+func (base36Codec) Name() string { return "base36" }
+func (base36Codec) tag() string  { return "8" }
+
+func (base36Codec) Encode(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	digits := new(big.Int).SetBytes(data).Text(36)
+	padded := strings.Repeat("0", base36Digits(len(data))-len(digits)) + digits
+	return splitLabels(padded, maxLabelSize)
+}
+
+func (base36Codec) Decode(labels string) ([]byte, error) {
+	digits := strings.ToLower(strings.ReplaceAll(labels, ".", ""))
+
+	// Every length of data has its own number of digits
+	n := len(digits) * 5 / 8
+	for base36Digits(n) < len(digits) {
+		n++
+	}
+	if base36Digits(n) != len(digits) {
+		return nil, fmt.Errorf("base36 decode error: %d digits", len(digits))
+	}
+
+	value, ok := new(big.Int).SetString(digits, 36)
+	if len(digits) > 0 && (!ok || value.BitLen() > 8*n) {
+		return nil, fmt.Errorf("base36 decode error: invalid digits")
+	}
+	decoded := make([]byte, n)
+	if n > 0 {
+		value.FillBytes(decoded)
+	}
+	return decoded, nil
+}
+
+func (base36Codec) EncodedLength(n int) int {
+	return labelledLength(base36Digits(n), maxLabelSize)
+}
+
+// base36Digits returns how many base-36 digits hold any n-byte number
+func base36Digits(n int) int {
+	if n == 0 {
+		return 0
+	}
+	largest := new(big.Int).Lsh(big.NewInt(1), uint(8*n))
+	return len(largest.Sub(largest, big.NewInt(1)).Text(36))
+}
+
+// rawCodec puts the bytes themselves in full-length labels. It needs a path
+// that passes arbitrary octets and preserves case.
+type rawCodec struct{}
+
+func (rawCodec) Name() string { return "raw" }
+func (rawCodec) tag() string  { return "1" }
+
+func (rawCodec) Encode(data []byte) string {
+	var b strings.Builder
+	for i, c := range data {
+		if i > 0 && i%maxLabelSize == 0 {
+			b.WriteByte('.')
+		}
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\%03d", c)
+		}
+	}
+	return b.String()
+}
+
+// Decode undoes both escape forms used for names in presentation format:
+// \DDD for any octet and \X for a special character
+func (rawCodec) Decode(labels string) ([]byte, error) {
+	decoded := make([]byte, 0, len(labels))
+	for i := 0; i < len(labels); i++ {
+		c := labels[i]
+		switch {
+		case c == '.':
+			continue
+		case c != '\\':
+			decoded = append(decoded, c)
+		case i+3 < len(labels) && isDigit(labels[i+1]) && isDigit(labels[i+2]) && isDigit(labels[i+3]):
+			n, err := strconv.Atoi(labels[i+1 : i+4])
+			if err != nil || n > 255 {
+				return nil, fmt.Errorf("invalid escape %q", labels[i:i+4])
+			}
+			decoded = append(decoded, byte(n))
+			i += 3
+		case i+1 < len(labels):
+			decoded = append(decoded, labels[i+1])
+			i++
+		default:
+			return nil, fmt.Errorf("truncated escape")
+		}
+	}
+	return decoded, nil
+}
+
+func (rawCodec) EncodedLength(n int) int {
+	return labelledLength(n, maxLabelSize)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -11,30 +11,140 @@ import (
 )
 
 const (
-	maxDNSPacketSize    = 512
-	maxChunkSize        = 220
-	maxLabelSize        = 63
-	maxRetries          = 3
-	dnsTimeout          = 5 * time.Second
-	retryDelay          = 500 * time.Millisecond
-	pollDelay           = 100 * time.Millisecond
-	sshPacketHeaderSize = 5
-	sessionIDLength     = 7
-	defaultTLD          = "edu"
-	maxSafeLabelSize    = 40
+	maxDNSPacketSize      = 512
+	maxResponseSize       = 4096
+	maxStreamResponseSize = 16 * 1024
+	maxPendingBytes       = 64 * 1024
+	maxChunkSize          = 220
+	maxLabelSize          = 63
+	maxNameLength         = 253
+	maxRetries            = 3
+	maxRetransmits        = 10
+	dnsTimeout            = 5 * time.Second
+	probeTimeout          = 1500 * time.Millisecond
+	probeAttempts         = 2
+	retryDelay            = 500 * time.Millisecond
+	pollDelay             = 100 * time.Millisecond
+	pollWait              = 50 * time.Millisecond
+	sessionLinger         = 30 * time.Second
+	reverseRetryDelay     = 5 * time.Second
+	maxReverseRetryDelay  = 5 * time.Minute
+	sshPacketHeaderSize   = 5
+	defaultTLD            = "edu"
+	maxSafeLabelSize      = 40
 )
 
-// DNS-safe base32 alphabet (no padding)
+// DNS-safe base32 alphabet (no padding). Names are matched and decoded
+// case-insensitively since resolvers may lowercase them or randomize their
+// case (DNS 0x20).
 const dnsBase32Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
 
 var dnsBase32 = base32.NewEncoding(dnsBase32Alphabet).WithPadding(base32.NoPadding)
 
-// Encode data preserving SSH packet boundaries
-func encodeDNSSafe(data []byte) string {
-	if len(data) == 0 {
-		return "EMPTY"
+// Frame protocol version
+const frameVersion = 1
+
+// Frame types
+const (
+	frameData      byte = 0x01 // Payload bytes for the destination connection
+	framePoll      byte = 0x02 // Client asks for pending downstream data
+	frameFin       byte = 0x03 // Orderly close of the session
+	frameRst       byte = 0x04 // Session is unknown or failed
+	frameKeepalive byte = 0x05 // No data; keeps the session alive
+	frameHandshake byte = 0x06 // Key exchange that sets up an authenticated session
+	frameProbe     byte = 0x07 // Tests whether a codec survives the resolver path
+)
+
+// Frame flags
+const (
+	flagReceived byte = 0x01 // Answer confirms the DATA frame with this Seq was accepted
+	flagFill     byte = 0x02 // Probe asks for an answer filling the requester's buffer
+)
+
+// Frame header: version(1) type(1) flags(1) session(4) seq(2) ack(2) length(2)
+const frameHeaderSize = 13
+
+// frame is the unit exchanged between client and server. It is carried
+// base32-encoded in both query names and TXT answers.
+type frame struct {
+	Type    byte
+	Flags   byte
+	Session uint32
+	Seq     uint16
+	Ack     uint16
+	Payload []byte
+}
+
+func frameTypeName(t byte) string {
+	switch t {
+	case frameData:
+		return "DATA"
+	case framePoll:
+		return "POLL"
+	case frameFin:
+		return "FIN"
+	case frameRst:
+		return "RST"
+	case frameKeepalive:
+		return "KEEPALIVE"
+	case frameHandshake:
+		return "HANDSHAKE"
+	case frameProbe:
+		return "PROBE"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", t)
+	}
+}
+
+// marshal serializes the frame header followed by its payload
+func (f *frame) marshal() []byte {
+	buf := make([]byte, frameHeaderSize+len(f.Payload))
+	buf[0] = frameVersion
+	buf[1] = f.Type
+	buf[2] = f.Flags
+	binary.BigEndian.PutUint32(buf[3:7], f.Session)
+	binary.BigEndian.PutUint16(buf[7:9], f.Seq)
+	binary.BigEndian.PutUint16(buf[9:11], f.Ack)
+	binary.BigEndian.PutUint16(buf[11:13], uint16(len(f.Payload)))
+	copy(buf[frameHeaderSize:], f.Payload)
+	return buf
+}
+
+// parseFrame validates and deserializes a frame
+func parseFrame(data []byte) (*frame, error) {
+	if len(data) < frameHeaderSize {
+		return nil, fmt.Errorf("frame too short: %d bytes", len(data))
+	}
+	if data[0] != frameVersion {
+		return nil, fmt.Errorf("unsupported frame version %d", data[0])
+	}
+
+	f := &frame{
+		Type:    data[1],
+		Flags:   data[2],
+		Session: binary.BigEndian.Uint32(data[3:7]),
+		Seq:     binary.BigEndian.Uint16(data[7:9]),
+		Ack:     binary.BigEndian.Uint16(data[9:11]),
+	}
+
+	switch f.Type {
+	case frameData, framePoll, frameFin, frameRst, frameKeepalive, frameHandshake, frameProbe:
+	default:
+		return nil, fmt.Errorf("unknown frame type %d", f.Type)
 	}
 
+	length := int(binary.BigEndian.Uint16(data[11:13]))
+	if len(data)-frameHeaderSize != length {
+		return nil, fmt.Errorf("frame length mismatch: header says %d, got %d", length, len(data)-frameHeaderSize)
+	}
+
+	f.Payload = make([]byte, length)
+	copy(f.Payload, data[frameHeaderSize:])
+	return f, nil
+}
+
+// Encode data preserving SSH packet boundaries
+func encodeDNSSafe(data []byte) string {
 	// Base32 encode
 	encoded := dnsBase32.EncodeToString(data)
 
@@ -71,17 +181,50 @@ func encodeDNSSafe(data []byte) string {
 	return result
 }
 
-// Decode data
-func decodeDNSSafe(s string) ([]byte, error) {
-	if s == "EMPTY" {
-		return []byte{}, nil
+// encodedLength returns the length of encodeDNSSafe's output for n bytes
+func encodedLength(n int) int {
+	chars := (n*8 + 4) / 5
+	if chars == 0 {
+		return 0
 	}
+	return chars + (chars-1)/maxSafeLabelSize
+}
+
+// normalizeDomain lowercases a zone name and strips surrounding dots
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.Trim(domain, "."))
+}
 
-	// Join parts if split across labels
-	s = strings.ReplaceAll(s, ".", "")
+// matchesTunnelPattern reports whether labels start with a codec tag or
+// every label could have come from encodeDNSSafe. Resolvers that minimize
+// query names ask about partial tunnel names, which match this pattern
+// without decoding to a frame.
+func matchesTunnelPattern(labels string) bool {
+	first, _, _ := strings.Cut(labels, ".")
+	if codecByTag(first) != nil {
+		return true
+	}
+
+	for _, label := range strings.Split(labels, ".") {
+		if label == "" || len(label) > maxSafeLabelSize {
+			return false
+		}
+		for _, c := range strings.ToUpper(label) {
+			if !strings.ContainsRune(dnsBase32Alphabet, c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Decode data
+func decodeDNSSafe(s string) ([]byte, error) {
+	// Join parts if split across labels, undoing any case changes
+	s = strings.ToUpper(strings.ReplaceAll(s, ".", ""))
 
 	// Base32 decode
-	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	decoded, err := dnsBase32.DecodeString(s)
 	if err != nil {
 		return nil, fmt.Errorf("base32 decode error: %v", err)
 	}
@@ -127,14 +270,10 @@ func splitIntoChunks(data []byte) [][]byte {
 	return chunks
 }
 
-func generateSessionID() string {
-	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
-	result := make([]byte, sessionIDLength)
-	for i := range result {
-		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
-		result[i] = chars[n.Int64()]
-	}
-	return string(result)
+func generateSessionID() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
 }
 
 func getRandomTLD() string {
@@ -143,36 +282,12 @@ func getRandomTLD() string {
 	return tlds[n.Int64()]
 }
 
-func addChecksumToData(data []byte) []byte {
-	// Add simple checksum
-	sum := byte(0)
-	for _, b := range data {
-		sum ^= b
-	}
-	return append(data, sum)
-}
-
-func verifyAndStripChecksum(data []byte) ([]byte, error) {
-	if len(data) < 1 {
-		return nil, fmt.Errorf("data too short")
-	}
-
-	checksum := data[len(data)-1]
-	data = data[:len(data)-1]
-
-	sum := byte(0)
-	for _, b := range data {
-		sum ^= b
-	}
-
-	if sum != checksum {
-		return nil, fmt.Errorf("checksum mismatch")
-	}
-
-	return data, nil
-}
-
+// splitDataIntoChunks splits data into pieces of at most chunkSize bytes.
+// It returns nil when chunkSize is not positive, since nothing would fit.
 func splitDataIntoChunks(data []byte, chunkSize int) [][]byte {
+	if chunkSize < 1 {
+		return nil
+	}
 	var chunks [][]byte
 	for i := 0; i < len(data); i += chunkSize {
 		end := i + chunkSize
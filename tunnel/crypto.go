@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Sealed envelope: marker(1) session(4) prefix(8) counter(4) ciphertext
+// tag(16). The marker tells envelopes apart from plaintext frames. The
+// nonce is prefix||counter and the counter guards against replay; the whole
+// header is authenticated as additional data. Clients use their key salt as
+// the prefix, while the server picks a random prefix for each cipher it
+// creates so two ciphers sharing a key can never repeat a nonce.
+const (
+	envelopeMarker     = 0x80 | frameVersion
+	envelopeSaltSize   = 8
+	envelopeHeaderSize = 1 + 4 + envelopeSaltSize + 4
+	envelopeOverhead   = envelopeHeaderSize + chacha20poly1305.Overhead
+)
+
+// Number of counters behind the highest seen that are still accepted
+const replayWindowSize = 1024
+
+// pskSaltMaxAge is how far a pre-shared key session's salt, which starts
+// with the time the client chose it, may be from the server's clock. The
+// server remembers each salt it has accepted for this long, so frames
+// replayed after their session is gone are still caught.
+const pskSaltMaxAge = 10 * time.Minute
+
+// sessionCipher seals and opens frames for one session with ChaCha20-Poly1305,
+// using a separate key for each direction
+type sessionCipher struct {
+	session uint32
+	salt    []byte
+	prefix  []byte
+	send    cipher.AEAD
+	recv    cipher.AEAD
+
+	mu      sync.Mutex
+	counter uint32
+	replay  replayWindow
+}
+
+func newSessionCipher(session uint32, salt, prefix, sendKey, recvKey []byte) (*sessionCipher, error) {
+	send, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionCipher{
+		session: session,
+		salt:    salt,
+		prefix:  prefix,
+		send:    send,
+		recv:    recv,
+	}, nil
+}
+
+// newPSKCipher derives per-direction session keys from a pre-shared key. The
+// random salt chosen by the client keeps keys unique even if a session ID
+// is ever reused.
+func newPSKCipher(psk []byte, session uint32, salt []byte, client bool) (*sessionCipher, error) {
+	info := make([]byte, 4)
+	binary.BigEndian.PutUint32(info, session)
+
+	kdf := hkdf.New(sha256.New, psk, salt, append([]byte("blind v1 frame keys"), info...))
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, err
+	}
+
+	upstream := keys[:chacha20poly1305.KeySize]
+	downstream := keys[chacha20poly1305.KeySize:]
+	if client {
+		return newSessionCipher(session, salt, salt, upstream, downstream)
+	}
+	return newSessionCipher(session, salt, newSessionSalt(), downstream, upstream)
+}
+
+// newSessionSalt returns a fresh random key salt or nonce prefix
+func newSessionSalt() []byte {
+	salt := make([]byte, envelopeSaltSize)
+	rand.Read(salt)
+	return salt
+}
+
+// newPSKSalt returns a key salt for a pre-shared key session: the current
+// Unix time followed by random bytes
+func newPSKSalt() []byte {
+	salt := newSessionSalt()
+	binary.BigEndian.PutUint32(salt, uint32(time.Now().Unix()))
+	return salt
+}
+
+// pskSaltTime returns when a pre-shared key session's salt was chosen
+func pskSaltTime(salt []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint32(salt)), 0)
+}
+
+// parseEnvelopeHeader returns the session an envelope was sealed for and its
+// nonce prefix, which for client envelopes is also the key salt
+func parseEnvelopeHeader(envelope []byte) (uint32, []byte, error) {
+	if len(envelope) < envelopeOverhead {
+		return 0, nil, fmt.Errorf("envelope too short: %d bytes", len(envelope))
+	}
+	if envelope[0] != envelopeMarker {
+		return 0, nil, fmt.Errorf("not a sealed envelope")
+	}
+	return binary.BigEndian.Uint32(envelope[1:5]), envelope[5 : 5+envelopeSaltSize], nil
+}
+
+// isEnvelope reports whether a payload is sealed rather than a plain frame
+func isEnvelope(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == envelopeMarker
+}
+
+// seal encrypts a marshaled frame under the next send counter
+func (c *sessionCipher) seal(plaintext []byte) ([]byte, error) {
+	c.mu.Lock()
+	if c.counter == math.MaxUint32 {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("session %08x exhausted its nonces", c.session)
+	}
+	counter := c.counter
+	c.counter++
+	c.mu.Unlock()
+
+	header := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(plaintext)+chacha20poly1305.Overhead)
+	header[0] = envelopeMarker
+	binary.BigEndian.PutUint32(header[1:5], c.session)
+	copy(header[5:], c.prefix)
+	binary.BigEndian.PutUint32(header[5+envelopeSaltSize:], counter)
+
+	return c.send.Seal(header, nonceFor(c.prefix, counter), plaintext, header), nil
+}
+
+// open authenticates and decrypts an envelope, rejecting anything that was
+// tampered with, sealed for another session, or already seen
+func (c *sessionCipher) open(envelope []byte) ([]byte, error) {
+	session, prefix, err := parseEnvelopeHeader(envelope)
+	if err != nil {
+		return nil, err
+	}
+	if session != c.session {
+		return nil, fmt.Errorf("envelope belongs to session %08x", session)
+	}
+
+	header := envelope[:envelopeHeaderSize]
+	counter := binary.BigEndian.Uint32(header[5+envelopeSaltSize:])
+
+	plaintext, err := c.recv.Open(nil, nonceFor(prefix, counter), envelope[envelopeHeaderSize:], header)
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.replay.accept(counter) {
+		return nil, fmt.Errorf("replayed frame (counter %d)", counter)
+	}
+	return plaintext, nil
+}
+
+func nonceFor(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[envelopeSaltSize:], counter)
+	return nonce
+}
+
+// replayWindow remembers which of the most recent counters have been seen
+type replayWindow struct {
+	highest uint32
+	seen    bool
+	bits    [replayWindowSize / 64]uint64
+}
+
+// accept records counter and reports whether it is new
+func (w *replayWindow) accept(counter uint32) bool {
+	if w.seen && counter <= w.highest {
+		if w.highest-counter >= replayWindowSize {
+			return false
+		}
+		if w.test(counter) {
+			return false
+		}
+		w.set(counter)
+		return true
+	}
+
+	// Slide forward, forgetting counters that fell out of the window
+	if !w.seen || counter-w.highest >= replayWindowSize {
+		w.bits = [replayWindowSize / 64]uint64{}
+	} else {
+		for c := w.highest + 1; c != counter; c++ {
+			w.clear(c)
+		}
+	}
+	w.highest = counter
+	w.seen = true
+	w.set(counter)
+	return true
+}
+
+func (w *replayWindow) test(counter uint32) bool {
+	i := counter % replayWindowSize
+	return w.bits[i/64]&(1<<(i%64)) != 0
+}
+
+func (w *replayWindow) set(counter uint32) {
+	i := counter % replayWindowSize
+	w.bits[i/64] |= 1 << (i % 64)
+}
+
+func (w *replayWindow) clear(counter uint32) {
+	i := counter % replayWindowSize
+	w.bits[i/64] &^= 1 << (i % 64)
+}
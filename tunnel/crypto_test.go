@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// pskPair returns the client and server ciphers of a pre-shared key session
+func pskPair(t *testing.T, psk []byte, session uint32, salt []byte) (*sessionCipher, *sessionCipher) {
+	t.Helper()
+	client, err := newPSKCipher(psk, session, salt, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newPSKCipher(psk, session, salt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestSealOpen(t *testing.T) {
+	client, server := pskPair(t, []byte("secret"), 0x1234, newPSKSalt())
+
+	for _, msg := range []string{"upstream", "", "more upstream"} {
+		envelope, err := client.seal([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := server.open(envelope)
+		if err != nil {
+			t.Fatalf("open %q: %v", msg, err)
+		}
+		if string(plaintext) != msg {
+			t.Errorf("opened %q, want %q", plaintext, msg)
+		}
+	}
+
+	envelope, err := server.seal([]byte("downstream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := client.open(envelope); err != nil || string(plaintext) != "downstream" {
+		t.Errorf("client opened %q, %v", plaintext, err)
+	}
+	// Each direction has its own key
+	if _, err := server.open(envelope); err == nil {
+		t.Error("server opened its own envelope")
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	psk := []byte("secret")
+	salt := newPSKSalt()
+	client, server := pskPair(t, psk, 0x1234, salt)
+	envelope, err := client.seal([]byte("frame"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(i int) []byte {
+		tampered := bytes.Clone(envelope)
+		tampered[i] ^= 0x01
+		return tampered
+	}
+	otherSalt := bytes.Clone(salt)
+	otherSalt[len(otherSalt)-1] ^= 0x01
+	_, wrongSalt := pskPair(t, psk, 0x1234, otherSalt)
+	_, wrongKey := pskPair(t, []byte("other"), 0x1234, salt)
+	_, wrongSession := pskPair(t, psk, 0x1235, salt)
+
+	tests := []struct {
+		name     string
+		cipher   *sessionCipher
+		envelope []byte
+	}{
+		{"short", server, envelope[:envelopeOverhead-1]},
+		{"marker", server, tamper(0)},
+		{"session", server, tamper(1)},
+		{"salt", server, tamper(5)},
+		{"counter", server, tamper(5 + envelopeSaltSize)},
+		{"ciphertext", server, tamper(envelopeHeaderSize)},
+		{"tag", server, tamper(len(envelope) - 1)},
+		{"salt mismatch", wrongSalt, envelope},
+		{"wrong key", wrongKey, envelope},
+		{"wrong session", wrongSession, envelope},
+	}
+	for _, tt := range tests {
+		if _, err := tt.cipher.open(tt.envelope); err == nil {
+			t.Errorf("%s: tampered envelope opened", tt.name)
+		}
+	}
+
+	// Rejected envelopes leave the counter unused
+	if _, err := server.open(envelope); err != nil {
+		t.Errorf("untampered envelope: %v", err)
+	}
+	if _, err := server.open(envelope); err == nil {
+		t.Error("replayed envelope opened")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		counters []uint32
+		want     []bool
+	}{
+		{"in order", []uint32{0, 1, 2}, []bool{true, true, true}},
+		{"duplicate", []uint32{0, 1, 1, 0}, []bool{true, true, false, false}},
+		{"reordered", []uint32{5, 3, 4, 3}, []bool{true, true, true, false}},
+		{"first counter not zero", []uint32{7, 7}, []bool{true, false}},
+		{"edge of window", []uint32{replayWindowSize, 1, 0}, []bool{true, true, false}},
+		{"behind window", []uint32{2000, 2000 - replayWindowSize, 2000 - replayWindowSize + 1}, []bool{true, false, true}},
+		{"large jump", []uint32{1, 2, 1 << 20, 2, 1<<20 - 1}, []bool{true, true, true, false, true}},
+		{"jump clears old bits", []uint32{3, 3 + replayWindowSize, 3 + 2*replayWindowSize - 1}, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		var w replayWindow
+		for i, counter := range tt.counters {
+			if got := w.accept(counter); got != tt.want[i] {
+				t.Errorf("%s: accept(%d) = %v, want %v", tt.name, counter, got, tt.want[i])
+			}
+		}
+	}
+}
+
+// Frames replayed once their session has been cleaned up must not open a
+// new session with a fresh replay window
+func TestReplayAfterCleanup(t *testing.T) {
+	psk := []byte("secret")
+	server := NewDNSServer("127.0.0.1:0", "127.0.0.1:1", false)
+	server.SetPSK(psk)
+
+	const sessionID = 0x1234
+	client, err := newPSKCipher(psk, sessionID, newPSKSalt(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll := &frame{Type: framePoll, Session: sessionID}
+	envelope, err := client.seal(poll.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, cipher, err := server.openFrame(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := newSession()
+	session.cipher = cipher
+	server.sessions[sessionID] = session
+	if _, _, err := server.openFrame(envelope); err == nil {
+		t.Fatal("envelope replayed into its session")
+	}
+
+	// The session is reaped while the salt is still accepted
+	server.mu.Lock()
+	delete(server.sessions, sessionID)
+	server.mu.Unlock()
+	session.Close()
+	server.forgetPSKCiphers()
+	if _, _, err := server.openFrame(envelope); err == nil {
+		t.Fatal("envelope replayed after cleanup")
+	}
+
+	// Later frames of the session still open
+	next, err := client.seal(poll.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.openFrame(next); err != nil {
+		t.Errorf("next frame after cleanup: %v", err)
+	}
+}
+
+func TestPSKSaltAge(t *testing.T) {
+	psk := []byte("secret")
+	server := NewDNSServer("127.0.0.1:0", "127.0.0.1:1", false)
+	server.SetPSK(psk)
+
+	tests := []struct {
+		name string
+		age  time.Duration
+		ok   bool
+	}{
+		{"fresh", 0, true},
+		{"recent", pskSaltMaxAge - time.Minute, true},
+		{"stale", pskSaltMaxAge + time.Minute, false},
+		{"future", -pskSaltMaxAge - time.Minute, false},
+	}
+	for i, tt := range tests {
+		salt := newSessionSalt()
+		binary.BigEndian.PutUint32(salt, uint32(time.Now().Add(-tt.age).Unix()))
+		sessionID := uint32(i + 1)
+		client, err := newPSKCipher(psk, sessionID, salt, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		poll := &frame{Type: framePoll, Session: sessionID}
+		envelope, err := client.seal(poll.marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := server.openFrame(envelope); (err == nil) != tt.ok {
+			t.Errorf("%s: openFrame error %v", tt.name, err)
+		}
+	}
+
+	// Ciphers are forgotten once their salt would be refused anyway
+	stale := pskSessionKey{session: 0xdead}
+	binary.BigEndian.PutUint32(stale.salt[:], uint32(time.Now().Add(-pskSaltMaxAge-time.Minute).Unix()))
+	server.pskCiphers[stale] = &sessionCipher{}
+	server.forgetPSKCiphers()
+	if _, kept := server.pskCiphers[stale]; kept {
+		t.Error("stale cipher kept")
+	}
+	if len(server.pskCiphers) != 2 {
+		t.Errorf("%d ciphers kept, want the 2 accepted", len(server.pskCiphers))
+	}
+}
@@ -0,0 +1,227 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// datagramPrefix marks an OPEN target as a UDP destination
+const datagramPrefix = "udp:"
+
+const (
+	// Datagrams are framed with a two-byte length
+	maxDatagramSize = 65535
+
+	// A datagram stream ends once no datagram has passed either way for
+	// this long, since UDP has no close of its own
+	datagramIdleTimeout = 2 * time.Minute
+
+	// Datagrams from a local peer queued while its stream is flow
+	// controlled; more are dropped, as a congested network would
+	datagramQueueSize = 64
+)
+
+// datagramConn carries datagrams as a byte stream of length-prefixed
+// frames, so a stream can hold them without losing their boundaries.
+// readPacket returns the next datagram, or io.EOF once the endpoint has
+// been idle for datagramIdleTimeout, and writePacket sends one.
+type datagramConn struct {
+	net.Conn
+	readPacket  func() ([]byte, error)
+	writePacket func([]byte) error
+
+	mu         sync.Mutex
+	lastActive time.Time
+
+	pending []byte // framed datagram not yet returned by Read
+	partial []byte // frames written but not yet complete
+}
+
+// newDatagramConn carries the datagrams of a connected UDP socket
+func newDatagramConn(conn *net.UDPConn) *datagramConn {
+	d := &datagramConn{Conn: conn, lastActive: time.Now()}
+	buffer := make([]byte, maxDatagramSize)
+	d.readPacket = func() ([]byte, error) {
+		for {
+			conn.SetReadDeadline(d.idleDeadline())
+			n, err := conn.Read(buffer)
+			if err == nil {
+				return buffer[:n], nil
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				return nil, err
+			}
+			// Datagrams sent the other way keep the stream open
+			if !time.Now().Before(d.idleDeadline()) {
+				return nil, io.EOF
+			}
+		}
+	}
+	d.writePacket = func(packet []byte) error {
+		_, err := conn.Write(packet)
+		return err
+	}
+	return d
+}
+
+// idleDeadline returns when the stream ends unless a datagram passes
+func (d *datagramConn) idleDeadline() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastActive.Add(datagramIdleTimeout)
+}
+
+func (d *datagramConn) touch() {
+	d.mu.Lock()
+	d.lastActive = time.Now()
+	d.mu.Unlock()
+}
+
+// Read returns the next framed datagram, in pieces if p is short
+func (d *datagramConn) Read(p []byte) (int, error) {
+	if len(d.pending) == 0 {
+		packet, err := d.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		d.touch()
+		d.pending = binary.BigEndian.AppendUint16(d.pending[:0], uint16(len(packet)))
+		d.pending = append(d.pending, packet...)
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// Write takes framed datagrams and sends each once it is complete. A
+// datagram the destination does not accept is dropped, as UDP would.
+func (d *datagramConn) Write(p []byte) (int, error) {
+	d.partial = append(d.partial, p...)
+	for len(d.partial) >= 2 {
+		size := int(binary.BigEndian.Uint16(d.partial))
+		if len(d.partial) < 2+size {
+			break
+		}
+		if err := d.writePacket(d.partial[2 : 2+size]); err != nil {
+			log.Printf("Failed to send datagram to %s: %v", d.RemoteAddr(), err)
+		}
+		d.partial = d.partial[2+size:]
+		d.touch()
+	}
+	return len(p), nil
+}
+
+// udpForward is a local UDP port whose datagrams are carried to target
+type udpForward struct {
+	listenAddr string
+	target     string
+}
+
+// serveUDP carries the datagrams arriving on a local UDP port to the
+// forward's target, with a stream for each local peer that replies are
+// returned to
+func (c *DNSClient) serveUDP(f udpForward) error {
+	addr, err := net.ResolveUDPAddr("udp", f.listenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid UDP listen address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start UDP listener: %v", err)
+	}
+	defer conn.Close()
+
+	if c.debug {
+		log.Printf("UDP listener started on %s for %s", f.listenAddr, f.target)
+	}
+
+	var mu sync.Mutex
+	peers := make(map[string]chan []byte)
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, peer, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return fmt.Errorf("UDP listener failed: %v", err)
+		}
+		packet := append([]byte(nil), buffer[:n]...)
+
+		mu.Lock()
+		queue, exists := peers[peer.String()]
+		if !exists {
+			queue = make(chan []byte, datagramQueueSize)
+			peers[peer.String()] = queue
+			go func() {
+				c.forwardDatagrams(conn, peer, queue, f.target)
+				mu.Lock()
+				delete(peers, peer.String())
+				mu.Unlock()
+			}()
+		}
+		select {
+		case queue <- packet:
+		default:
+			if c.debug {
+				log.Printf("Dropped datagram from %s: stream is backed up", peer)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// forwardDatagrams carries one local peer's datagrams as a stream to
+// target and sends the replies back to it, until the stream ends
+func (c *DNSClient) forwardDatagrams(conn *net.UDPConn, peer *net.UDPAddr, queue chan []byte, target string) {
+	stream, err := c.openStream(datagramPrefix + target)
+	if err != nil {
+		log.Printf("Failed to open stream: %v", err)
+		return
+	}
+
+	d := &datagramConn{Conn: &udpPeerConn{conn, peer}, lastActive: time.Now()}
+	d.readPacket = func() ([]byte, error) {
+		for {
+			timer := time.NewTimer(time.Until(d.idleDeadline()))
+			select {
+			case packet := <-queue:
+				timer.Stop()
+				return packet, nil
+			case <-stream.done:
+				timer.Stop()
+				return nil, io.EOF
+			case <-timer.C:
+				// Replies keep the stream open
+				if !time.Now().Before(d.idleDeadline()) {
+					return nil, io.EOF
+				}
+			}
+		}
+	}
+	d.writePacket = func(packet []byte) error {
+		_, err := conn.WriteToUDP(packet, peer)
+		return err
+	}
+
+	if stream.attach(d) {
+		<-stream.done
+	}
+}
+
+// udpPeerConn is the net.Conn a local UDP peer's datagram stream is
+// attached as. Closing it leaves the shared listener open.
+type udpPeerConn struct {
+	*net.UDPConn
+	peer *net.UDPAddr
+}
+
+func (u *udpPeerConn) RemoteAddr() net.Addr {
+	return u.peer
+}
+
+func (u *udpPeerConn) Close() error {
+	return nil
+}
@@ -0,0 +1,212 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recorder is the ResponseWriter the DoH stand-in hands to the server. It
+// reports a TCP peer, as a resolver relaying over a stream would.
+type recorder struct {
+	reply *dns.Msg
+}
+
+func (r *recorder) LocalAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (r *recorder) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+func (r *recorder) WriteMsg(m *dns.Msg) error { r.reply = m; return nil }
+func (r *recorder) Write(b []byte) (int, error) {
+	r.reply = new(dns.Msg)
+	return len(b), r.reply.Unpack(b)
+}
+func (r *recorder) Close() error        { return nil }
+func (r *recorder) TsigStatus() error   { return nil }
+func (r *recorder) TsigTimersOnly(bool) {}
+func (r *recorder) Hijack()             {}
+
+// dohStandIn serves RFC 8484 requests by passing them to server, failing
+// the test on requests that do not use method
+func dohStandIn(t *testing.T, server *DNSServer, method string, requests *atomic.Int64) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if req.Method != method {
+			t.Errorf("got %s request, want %s", req.Method, method)
+		}
+		if accept := req.Header.Get("Accept"); accept != dohContentType {
+			t.Errorf("Accept is %q", accept)
+		}
+
+		var packed []byte
+		var err error
+		switch req.Method {
+		case http.MethodGet:
+			packed, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if ct := req.Header.Get("Content-Type"); ct != dohContentType {
+				t.Errorf("Content-Type is %q", ct)
+			}
+			packed, err = io.ReadAll(req.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(packed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if msg.Id != 0 {
+			t.Errorf("query ID is %d, want 0", msg.Id)
+		}
+
+		rec := &recorder{}
+		server.handleDNSRequest(rec, msg)
+		if rec.reply == nil {
+			http.Error(w, "no reply", http.StatusBadGateway)
+			return
+		}
+		reply, err := rec.reply.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(reply)
+	}))
+}
+
+// echoListener accepts connections and echoes what they send
+func echoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestDoHTunnel(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		t.Run(method, func(t *testing.T) {
+			echo := echoListener(t)
+			server := NewDNSServer("", echo.Addr().String(), false)
+			server.SetPSK([]byte("doh test key"))
+
+			var requests atomic.Int64
+			ts := dohStandIn(t, server, method, &requests)
+			defer ts.Close()
+
+			client, err := NewDNSClient("", ts.URL+"/dns-query", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SetPSK([]byte("doh test key"))
+			if err := client.SetDoHMethod(method); err != nil {
+				t.Fatal(err)
+			}
+			doh, ok := client.resolvers.all[0].transport.(*dohTransport)
+			if !ok {
+				t.Fatalf("https URL gave %T, want DoH transport", client.resolvers.all[0].transport)
+			}
+			doh.client = ts.Client()
+
+			local, remote := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				client.handleConnection(remote)
+				close(done)
+			}()
+
+			data := make([]byte, 8*1024)
+			rand.Read(data)
+			go local.Write(data)
+
+			got := make([]byte, len(data))
+			local.SetReadDeadline(time.Now().Add(30 * time.Second))
+			if _, err := io.ReadFull(local, got); err != nil {
+				t.Fatalf("reading echo: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("echo does not match what was sent")
+			}
+
+			local.Close()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("session did not end after the connection closed")
+			}
+			if requests.Load() == 0 {
+				t.Fatal("no queries reached the DoH stand-in")
+			}
+			if path, err := client.sessionPath(); err != nil || path.udpSize != maxResponseSize {
+				t.Errorf("probed %v, want answers filling %d bytes", path, maxResponseSize)
+			}
+		})
+	}
+}
+
+func TestDoHHTTPError(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	doh := &dohTransport{url: ts.URL, client: ts.Client()}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.edu.", dns.TypeTXT)
+
+	if _, _, err := doh.exchange(context.Background(), msg); err == nil {
+		t.Fatal("exchange succeeded despite HTTP 502")
+	}
+}
+
+func TestDoHMethod(t *testing.T) {
+	client, err := NewDNSClient("", "https://dns.example.com/dns-query", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetDoHMethod("get"); err != nil {
+		t.Fatal(err)
+	}
+	if !client.resolvers.all[0].transport.(*dohTransport).get {
+		t.Error("GET was not selected")
+	}
+	if err := client.SetDoHMethod("PUT"); err == nil {
+		t.Error("PUT was accepted")
+	}
+
+	plain, err := NewDNSClient("", "127.0.0.1:53", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plain.resolvers.all[0].transport.(*dnsTransport); !ok {
+		t.Errorf("host:port gave %T, want plain DNS transport", plain.resolvers.all[0].transport)
+	}
+}
@@ -0,0 +1,373 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Sessions are set up with the Noise IK pattern: the client already knows
+// the server's static key, sends its own static key encrypted in the first
+// message, and both sides mix in fresh ephemeral keys so a leaked long-term
+// key cannot decrypt recorded traffic.
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se
+const noiseProtocolName = "Noise_IK_25519_ChaChaPoly_SHA256"
+
+// Handshake message sizes. The first message carries the client's envelope
+// salt as its payload.
+const (
+	handshakeInitSize  = 32 + 32 + chacha20poly1305.Overhead + envelopeSaltSize + chacha20poly1305.Overhead
+	handshakeReplySize = 32 + chacha20poly1305.Overhead
+)
+
+// KeyPair is a long-term X25519 identity
+type KeyPair struct {
+	private *ecdh.PrivateKey
+}
+
+// GenerateKeyPair creates a new random identity
+func GenerateKeyPair() (*KeyPair, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{private: private}, nil
+}
+
+// LoadKeyPair reads a base64 private key written by Save
+func LoadKeyPair(path string) (*KeyPair, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", path, err)
+	}
+
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %v", path, err)
+	}
+	return &KeyPair{private: private}, nil
+}
+
+// Save writes the private key to path, readable only by its owner
+func (k *KeyPair) Save(path string) error {
+	encoded := base64.StdEncoding.EncodeToString(k.private.Bytes()) + "\n"
+	return os.WriteFile(path, []byte(encoded), 0600)
+}
+
+// PublicKey returns the base64 public key to share with the other side
+func (k *KeyPair) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(k.private.PublicKey().Bytes())
+}
+
+// parsePublicKey decodes a base64 X25519 public key
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// AuthorizedKeys maps each permitted client public key (base64) to the
+// comment that followed it in the authorized keys file
+type AuthorizedKeys map[string]string
+
+// LoadAuthorizedKeys reads one base64 public key per line, optionally
+// followed by a comment. Blank lines and lines starting with # are skipped.
+func LoadAuthorizedKeys(path string) (AuthorizedKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(AuthorizedKeys)
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(text, " ", 2)
+		key, err := parsePublicKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+
+		comment := ""
+		if len(fields) > 1 {
+			comment = strings.TrimSpace(fields[1])
+		}
+		keys[base64.StdEncoding.EncodeToString(key.Bytes())] = comment
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// handshakePrologue binds the handshake to the session and, when one is
+// configured, to the pre-shared key
+func handshakePrologue(session uint32, psk []byte) []byte {
+	prologue := []byte("blind handshake")
+	prologue = binary.BigEndian.AppendUint32(prologue, session)
+	return append(prologue, psk...)
+}
+
+// symmetricState is the Noise chaining key, handshake hash and cipher key
+type symmetricState struct {
+	ck []byte
+	h  []byte
+	k  []byte
+	n  uint64
+}
+
+func newSymmetricState(prologue []byte) *symmetricState {
+	name := []byte(noiseProtocolName)
+	ss := &symmetricState{h: make([]byte, sha256.Size)}
+	copy(ss.h, name)
+	ss.ck = append([]byte(nil), ss.h...)
+	ss.mixHash(prologue)
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	ss.ck, ss.k = noiseHKDF(ss.ck, ikm)
+	ss.n = 0
+}
+
+func (ss *symmetricState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], ss.n)
+	ss.n++
+	return nonce
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(ss.k)
+	ciphertext := aead.Seal(nil, ss.nonce(), plaintext, ss.h)
+	ss.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(ss.k)
+	plaintext, err := aead.Open(nil, ss.nonce(), ciphertext, ss.h)
+	if err != nil {
+		return nil, fmt.Errorf("handshake authentication failed")
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the initiator and responder transport keys
+func (ss *symmetricState) split() ([]byte, []byte) {
+	return noiseHKDF(ss.ck, nil)
+}
+
+// noiseHKDF is the two-output HKDF defined by the Noise specification
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+func dh(private *ecdh.PrivateKey, public *ecdh.PublicKey) ([]byte, error) {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %v", err)
+	}
+	return shared, nil
+}
+
+// clientHandshake is the initiator state kept between the two messages
+type clientHandshake struct {
+	ss        *symmetricState
+	ephemeral *ecdh.PrivateKey
+	identity  *KeyPair
+	session   uint32
+	salt      []byte
+}
+
+// newClientHandshake builds the first handshake message for a session
+func newClientHandshake(identity *KeyPair, serverKey *ecdh.PublicKey, session uint32, psk []byte) (*clientHandshake, []byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hs := &clientHandshake{
+		ss:        newSymmetricState(handshakePrologue(session, psk)),
+		ephemeral: ephemeral,
+		identity:  identity,
+		session:   session,
+		salt:      newSessionSalt(),
+	}
+	hs.ss.mixHash(serverKey.Bytes())
+
+	// -> e, es
+	msg := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+	hs.ss.mixHash(ephemeral.PublicKey().Bytes())
+	es, err := dh(ephemeral, serverKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.ss.mixKey(es)
+
+	// -> s, ss
+	msg = append(msg, hs.ss.encryptAndHash(identity.private.PublicKey().Bytes())...)
+	ss, err := dh(identity.private, serverKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.ss.mixKey(ss)
+
+	msg = append(msg, hs.ss.encryptAndHash(hs.salt)...)
+	return hs, msg, nil
+}
+
+// finish processes the server's reply and returns the session cipher
+func (hs *clientHandshake) finish(reply []byte) (*sessionCipher, error) {
+	if len(reply) != handshakeReplySize {
+		return nil, fmt.Errorf("handshake reply has %d bytes, expected %d", len(reply), handshakeReplySize)
+	}
+
+	// <- e, ee, se
+	serverEphemeral, err := ecdh.X25519().NewPublicKey(reply[:32])
+	if err != nil {
+		return nil, err
+	}
+	hs.ss.mixHash(serverEphemeral.Bytes())
+
+	ee, err := dh(hs.ephemeral, serverEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	hs.ss.mixKey(ee)
+
+	se, err := dh(hs.identity.private, serverEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	hs.ss.mixKey(se)
+
+	if _, err := hs.ss.decryptAndHash(reply[32:]); err != nil {
+		return nil, err
+	}
+
+	upstream, downstream := hs.ss.split()
+	return newSessionCipher(hs.session, hs.salt, hs.salt, upstream, downstream)
+}
+
+// respondHandshake processes a client's first message. It returns the
+// reply, the session cipher and the client's public key (base64), which the
+// caller must check against its authorized keys before using the session.
+func respondHandshake(identity *KeyPair, session uint32, psk, msg []byte) ([]byte, *sessionCipher, string, error) {
+	if len(msg) != handshakeInitSize {
+		return nil, nil, "", fmt.Errorf("handshake has %d bytes, expected %d", len(msg), handshakeInitSize)
+	}
+
+	ss := newSymmetricState(handshakePrologue(session, psk))
+	ss.mixHash(identity.private.PublicKey().Bytes())
+
+	// -> e, es
+	clientEphemeral, err := ecdh.X25519().NewPublicKey(msg[:32])
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ss.mixHash(clientEphemeral.Bytes())
+	es, err := dh(identity.private, clientEphemeral)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ss.mixKey(es)
+
+	// -> s, ss
+	staticEnd := 32 + 32 + chacha20poly1305.Overhead
+	rawStatic, err := ss.decryptAndHash(msg[32:staticEnd])
+	if err != nil {
+		return nil, nil, "", err
+	}
+	clientStatic, err := ecdh.X25519().NewPublicKey(rawStatic)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	shared, err := dh(identity.private, clientStatic)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ss.mixKey(shared)
+
+	salt, err := ss.decryptAndHash(msg[staticEnd:])
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// <- e, ee, se
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	reply := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+	ss.mixHash(ephemeral.PublicKey().Bytes())
+
+	ee, err := dh(ephemeral, clientEphemeral)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ss.mixKey(ee)
+
+	se, err := dh(ephemeral, clientStatic)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	ss.mixKey(se)
+
+	reply = append(reply, ss.encryptAndHash(nil)...)
+
+	upstream, downstream := ss.split()
+	cipher, err := newSessionCipher(session, salt, newSessionSalt(), downstream, upstream)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return reply, cipher, base64.StdEncoding.EncodeToString(clientStatic.Bytes()), nil
+}
@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func generateKeyPair(t *testing.T) *KeyPair {
+	t.Helper()
+	key, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHandshake(t *testing.T) {
+	for _, psk := range [][]byte{nil, []byte("secret")} {
+		server := generateKeyPair(t)
+		client := generateKeyPair(t)
+
+		hs, msg, err := newClientHandshake(client, server.private.PublicKey(), 0x1234, psk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, serverCipher, clientKey, err := respondHandshake(server, 0x1234, psk, msg)
+		if err != nil {
+			t.Fatalf("respondHandshake: %v", err)
+		}
+		if clientKey != client.PublicKey() {
+			t.Errorf("server saw client key %s, want %s", clientKey, client.PublicKey())
+		}
+		clientCipher, err := hs.finish(reply)
+		if err != nil {
+			t.Fatalf("finish: %v", err)
+		}
+
+		envelope, err := clientCipher.seal([]byte("upstream"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext, err := serverCipher.open(envelope); err != nil || string(plaintext) != "upstream" {
+			t.Errorf("server opened %q, %v", plaintext, err)
+		}
+		envelope, err = serverCipher.seal([]byte("downstream"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext, err := clientCipher.open(envelope); err != nil || string(plaintext) != "downstream" {
+			t.Errorf("client opened %q, %v", plaintext, err)
+		}
+	}
+}
+
+func TestHandshakeRejects(t *testing.T) {
+	server := generateKeyPair(t)
+	client := generateKeyPair(t)
+
+	// The server must hold the key the client pinned, and the same PSK
+	_, msg, err := newClientHandshake(client, generateKeyPair(t).private.PublicKey(), 0x1234, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := respondHandshake(server, 0x1234, nil, msg); err == nil {
+		t.Error("handshake for another server key accepted")
+	}
+	_, msg, err = newClientHandshake(client, server.private.PublicKey(), 0x1234, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := respondHandshake(server, 0x1234, []byte("other"), msg); err == nil {
+		t.Error("handshake with another PSK accepted")
+	}
+	if _, _, _, err := respondHandshake(server, 0x1235, []byte("secret"), msg); err == nil {
+		t.Error("handshake for another session accepted")
+	}
+
+	// Any change to the reply fails finish
+	for _, i := range []int{0, 31, 32, handshakeReplySize - 1} {
+		hs, msg, err := newClientHandshake(client, server.private.PublicKey(), 0x1234, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, _, _, err := respondHandshake(server, 0x1234, nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply[i] ^= 0x01
+		if _, err := hs.finish(reply); err == nil {
+			t.Errorf("reply tampered at byte %d accepted", i)
+		}
+	}
+
+	hs, _, err := newClientHandshake(client, server.private.PublicKey(), 0x1234, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hs.finish(make([]byte, handshakeReplySize-1)); err == nil {
+		t.Error("short reply accepted")
+	}
+}
+
+func TestHandleHandshake(t *testing.T) {
+	// Nothing may ever connect to the destination
+	dest, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+
+	identity := generateKeyPair(t)
+	authorized := generateKeyPair(t)
+	server := NewDNSServer("127.0.0.1:0", dest.Addr().String(), false)
+	server.SetIdentity(identity, AuthorizedKeys{authorized.PublicKey(): "test"})
+
+	// An unknown client is refused without a session
+	_, msg, err := newClientHandshake(generateKeyPair(t), identity.private.PublicKey(), 0x1111, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.handleHandshake(&frame{Type: frameHandshake, Session: 0x1111, Payload: msg}); err == nil {
+		t.Error("unauthorized client key accepted")
+	}
+	if len(server.sessions) != 0 {
+		t.Errorf("unauthorized handshake left %d sessions", len(server.sessions))
+	}
+
+	// A retransmitted handshake gets the reply already sent
+	hs, msg, err := newClientHandshake(authorized, identity.private.PublicKey(), 0x2222, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &frame{Type: frameHandshake, Session: 0x2222, Payload: msg}
+	first, err := server.handleHandshake(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.closeSession(0x2222)
+	again, err := server.handleHandshake(f)
+	if err != nil {
+		t.Fatalf("retransmitted handshake: %v", err)
+	}
+	if !bytes.Equal(first.Payload, again.Payload) {
+		t.Error("retransmitted handshake got a new reply")
+	}
+	if _, err := hs.finish(again.Payload); err != nil {
+		t.Errorf("finish with the stored reply: %v", err)
+	}
+
+	// A second handshake cannot take over the session
+	_, other, err := newClientHandshake(authorized, identity.private.PublicKey(), 0x2222, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.handleHandshake(&frame{Type: frameHandshake, Session: 0x2222, Payload: other}); err == nil {
+		t.Error("second handshake for an established session accepted")
+	}
+
+	dest.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if conn, err := dest.Accept(); err == nil {
+		conn.Close()
+		t.Error("handshake dialed the destination")
+	}
+}
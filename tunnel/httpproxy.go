@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpProxyHeaderTimeout bounds how long an HTTP proxy client may take to
+// send its request headers
+const httpProxyHeaderTimeout = 30 * time.Second
+
+// handleHTTPProxy reads one HTTP proxy request and carries the connection
+// as a stream to the target it names. A CONNECT tunnels the connection
+// once the server has connected; an absolute-URI request is forwarded in
+// origin form, and the connection ends with its response.
+func (c *DNSClient) handleHTTPProxy(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(httpProxyHeaderTimeout))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		if c.debug {
+			log.Printf("HTTP proxy request from %s failed: %v", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	target, err := proxyTarget(req)
+	if err != nil {
+		if c.debug {
+			log.Printf("HTTP proxy request from %s refused: %v", conn.RemoteAddr(), err)
+		}
+		writeHTTPProxyError(conn, http.StatusBadRequest)
+		conn.Close()
+		return
+	}
+
+	if c.debug {
+		log.Printf("HTTP proxy %s to %s", req.Method, target)
+	}
+
+	stream, err := c.connectStream(target)
+	if err != nil {
+		log.Printf("HTTP proxy %s to %s failed: %v", req.Method, target, err)
+		status := http.StatusBadGateway
+		var refused *refusal
+		if errors.As(err, &refused) && refused.reason == resetNotAllowed {
+			status = http.StatusForbidden
+		}
+		writeHTTPProxyError(conn, status)
+		conn.Close()
+		return
+	}
+
+	var local *proxiedConn
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			stream.abort()
+			conn.Close()
+			return
+		}
+		// The client may already have sent data behind the request
+		local = &proxiedConn{Conn: conn, r: reader}
+	} else {
+		local = forwardRequest(conn, req)
+	}
+
+	if stream.attach(local) {
+		<-stream.done
+	}
+}
+
+// proxyTarget returns the host:port a proxy request is for: the authority
+// of a CONNECT, or the host of an absolute http:// URI
+func proxyTarget(req *http.Request) (string, error) {
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			return "", fmt.Errorf("CONNECT to %q has no port", req.Host)
+		}
+		return req.Host, nil
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return "", fmt.Errorf("%s %s is not an absolute http:// URI", req.Method, req.URL)
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port), nil
+}
+
+// forwardRequest returns conn with reads replaced by req rewritten for the
+// origin server: in origin form, without proxy headers and asking the
+// server to close once it has answered. Later requests on the connection
+// are not forwarded, since they may be for another host.
+func forwardRequest(conn net.Conn, req *http.Request) *proxiedConn {
+	for _, name := range strings.Split(req.Header.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			req.Header.Del(name)
+		}
+	}
+	for _, name := range []string{"Connection", "Proxy-Connection", "Proxy-Authorization", "Keep-Alive"} {
+		req.Header.Del(name)
+	}
+	req.Close = true
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(req.Write(pw))
+	}()
+	return &proxiedConn{Conn: conn, r: pr}
+}
+
+// writeHTTPProxyError answers a proxy request that could not be carried
+func writeHTTPProxyError(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status))
+}
+
+// proxiedConn is a local connection whose reads come from r, which holds
+// what was read past the proxy request or the rewritten request itself
+type proxiedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (p *proxiedConn) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection when it supports it,
+// so the stream keeps passing the peer's close on
+func (p *proxiedConn) CloseWrite() error {
+	if cw, ok := p.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return p.Conn.Close()
+}
+
+func (p *proxiedConn) Close() error {
+	if closer, ok := p.r.(io.Closer); ok {
+		closer.Close()
+	}
+	return p.Conn.Close()
+}
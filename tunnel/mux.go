@@ -0,0 +1,658 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A session is one reliable byte stream between client and server. The mux
+// carries many TCP connections over it as streams, each a series of
+// records: type(1) stream(4) length(2) payload. Clients open odd stream IDs
+// and servers even ones. OPEN names the host:port the stream is for, or
+// one of the accepting side's named mappings, or is empty for its default
+// destination. A target prefixed with "udp:" opens a datagram stream, which
+// carries each datagram with a two-byte length so boundaries survive.
+// LISTEN asks the peer to listen on an address and open a stream back to
+// that address for each connection, as for reverse forwarding; its stream
+// ID stands for the listener until reset.
+
+// Record types
+const (
+	muxOpen   byte = 0x01 // Opens a stream
+	muxData   byte = 0x02 // Bytes for the stream's connection
+	muxWindow byte = 0x03 // Lets the peer send more bytes on the stream
+	muxClose  byte = 0x04 // Sender has no more data for the stream
+	muxReset  byte = 0x05 // Stream failed and is discarded
+	muxReady  byte = 0x06 // Accepting side has connected the stream
+	muxListen byte = 0x07 // Asks the peer to listen and open streams back
+)
+
+// Reasons a RESET may carry in its one-byte payload, telling the opener
+// why the accepting side could not connect the stream
+const (
+	resetFailed      byte = 0x00 // Any other failure; sent as an empty payload
+	resetNotAllowed  byte = 0x01 // Destination policy denied the target
+	resetUnreachable byte = 0x02 // Target could not be resolved or reached
+	resetRefused     byte = 0x03 // Target refused the connection
+)
+
+// refusal is an error connecting a stream along with the reason to send
+type refusal struct {
+	reason byte
+	err    error
+}
+
+func (r *refusal) Error() string {
+	return r.err.Error()
+}
+
+func (r *refusal) Unwrap() error {
+	return r.err
+}
+
+// dialRefusal returns the refusal for a failed dial
+func dialRefusal(err error) *refusal {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return &refusal{resetRefused, err}
+	}
+	return &refusal{resetUnreachable, err}
+}
+
+// resetReasonText describes a RESET reason for errors on the opening side
+func resetReasonText(reason byte) string {
+	switch reason {
+	case resetNotAllowed:
+		return "destination not allowed by server policy"
+	case resetUnreachable:
+		return "destination unreachable"
+	case resetRefused:
+		return "destination refused the connection"
+	default:
+		return "server could not connect"
+	}
+}
+
+const (
+	muxHeaderSize = 7
+
+	// Each side may have at most streamWindow bytes of a stream in flight
+	// or unwritten at the peer, so one slow connection cannot fill the
+	// session and stall the others
+	streamWindow = 64 * 1024
+
+	// Records are kept small so streams interleave within the session
+	maxRecordPayload = 1024
+)
+
+var errMuxClosed = errors.New("session is closed")
+
+// isMappingName reports whether an OPEN target names a mapping rather than
+// a host:port, which always has a colon
+func isMappingName(target string) bool {
+	return target != "" && !strings.Contains(target, ":")
+}
+
+func muxTypeName(t byte) string {
+	switch t {
+	case muxOpen:
+		return "OPEN"
+	case muxData:
+		return "DATA"
+	case muxWindow:
+		return "WINDOW"
+	case muxClose:
+		return "CLOSE"
+	case muxReset:
+		return "RESET"
+	case muxReady:
+		return "READY"
+	case muxListen:
+		return "LISTEN"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", t)
+	}
+}
+
+// mux multiplexes streams over a session. Read returns the records to send
+// to the peer and Write takes the records the peer sent; neither write nor
+// dispatch blocks, since flow control bounds what each stream buffers.
+type mux struct {
+	// accept returns the connection for a stream the peer opens to target,
+	// or nil when the peer may not open streams
+	accept func(target string) (net.Conn, error)
+	debug  bool
+
+	// listen returns a listener on addr for the peer, whose connections
+	// are opened back to the peer as streams to addr, or is nil when the
+	// peer may not ask for listeners
+	listen func(addr string) (net.Listener, error)
+
+	mu        sync.Mutex
+	cond      *sync.Cond // signaled when out grows or the mux closes
+	out       []byte
+	in        []byte
+	streams   map[uint32]*stream
+	nextID    uint32
+	closed    bool
+	idleSince time.Time
+}
+
+func newMux(client bool, accept func(target string) (net.Conn, error), debug bool) *mux {
+	m := &mux{
+		accept:    accept,
+		debug:     debug,
+		streams:   make(map[uint32]*stream),
+		nextID:    2,
+		idleSince: time.Now(),
+	}
+	if client {
+		m.nextID = 1
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// stream is one connection carried by the mux. Its state is guarded by the
+// mux's lock, and cond is signaled whenever it changes.
+type stream struct {
+	id   uint32
+	mux  *mux
+	conn net.Conn // nil until attached
+	cond *sync.Cond
+
+	credit       int    // bytes the peer will still accept
+	inbound      []byte // received but not yet written to conn
+	consumed     int    // written to conn since the last window update
+	localClosed  bool   // CLOSE sent
+	remoteClosed bool   // CLOSE received
+	flushed      bool   // everything received was written before the close
+	reset        bool
+	reason       byte // why the stream was reset, from the RESET record
+
+	// ready is closed once the peer has connected the stream, and done
+	// once the stream has finished either way
+	ready     chan struct{}
+	connected bool
+	done      chan struct{}
+}
+
+func (m *mux) newStream(id uint32) *stream {
+	st := &stream{
+		id:     id,
+		mux:    m,
+		cond:   sync.NewCond(&m.mu),
+		credit: streamWindow,
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	m.streams[id] = st
+	return st
+}
+
+// open starts a stream to target, which may be empty for the peer's
+// default destination. What the peer sends is buffered until a connection
+// is attached, so a caller may wait for ready before attaching.
+func (m *mux) open(target string) (*stream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errMuxClosed
+	}
+	st := m.newStream(m.nextID)
+	m.nextID += 2
+	m.queue(muxOpen, st.id, []byte(target))
+
+	if m.debug {
+		log.Printf("Opened stream %d to %q", st.id, target)
+	}
+	return st, nil
+}
+
+// attach starts carrying conn on the stream. It reports false, closing
+// conn, if the stream has already finished.
+func (st *stream) attach(conn net.Conn) bool {
+	m := st.mux
+	m.mu.Lock()
+	if st.reset {
+		m.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	st.conn = conn
+	m.mu.Unlock()
+
+	go st.readLoop()
+	go st.writeLoop()
+	return true
+}
+
+// abort resets a stream that is no longer wanted
+func (st *stream) abort() {
+	st.mux.mu.Lock()
+	st.mux.resetStream(st, true)
+	st.mux.mu.Unlock()
+}
+
+// queue appends a record to the outgoing data. The caller holds mu.
+func (m *mux) queue(t byte, id uint32, payload []byte) {
+	var header [muxHeaderSize]byte
+	header[0] = t
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint16(header[5:7], uint16(len(payload)))
+	m.out = append(m.out, header[:]...)
+	m.out = append(m.out, payload...)
+	m.cond.Broadcast()
+}
+
+// Read returns outgoing record bytes, waiting until there are some. It
+// returns io.EOF once the mux is closed.
+func (m *mux) Read(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.out) == 0 && !m.closed {
+		m.cond.Wait()
+	}
+	if m.closed {
+		return 0, io.EOF
+	}
+	n := copy(p, m.out)
+	m.out = m.out[n:]
+	return n, nil
+}
+
+// Write takes incoming record bytes and dispatches every complete record
+func (m *mux) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return 0, errMuxClosed
+	}
+
+	m.in = append(m.in, p...)
+	for len(m.in) >= muxHeaderSize {
+		length := int(binary.BigEndian.Uint16(m.in[5:7]))
+		if len(m.in) < muxHeaderSize+length {
+			break
+		}
+		t := m.in[0]
+		id := binary.BigEndian.Uint32(m.in[1:5])
+		payload := m.in[muxHeaderSize : muxHeaderSize+length]
+		m.in = m.in[muxHeaderSize+length:]
+
+		if err := m.dispatch(t, id, payload); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// dispatch applies one incoming record. The caller holds mu.
+func (m *mux) dispatch(t byte, id uint32, payload []byte) error {
+	if t == muxOpen {
+		m.accepted(id, string(payload))
+		return nil
+	}
+	if t == muxListen {
+		m.listenRequested(id, string(payload))
+		return nil
+	}
+
+	st, exists := m.streams[id]
+	if !exists {
+		// Late records for a stream already gone; make sure the peer
+		// lets go of it too
+		if t != muxReset {
+			if m.debug {
+				log.Printf("%s record for unknown stream %d", muxTypeName(t), id)
+			}
+			m.queue(muxReset, id, nil)
+		}
+		return nil
+	}
+
+	switch t {
+	case muxData:
+		if st.remoteClosed || len(st.inbound)+st.consumed+len(payload) > streamWindow {
+			if m.debug {
+				log.Printf("Stream %d overran its window", id)
+			}
+			m.resetStream(st, true)
+			return nil
+		}
+		st.inbound = append(st.inbound, payload...)
+
+	case muxWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("window update of %d bytes", len(payload))
+		}
+		st.credit += int(binary.BigEndian.Uint32(payload))
+
+	case muxClose:
+		st.remoteClosed = true
+
+	case muxReady:
+		if !st.connected {
+			st.connected = true
+			close(st.ready)
+		}
+
+	case muxReset:
+		if len(payload) > 0 {
+			st.reason = payload[0]
+		}
+		if m.debug {
+			log.Printf("Stream %d reset by peer: %s", id, resetReasonText(st.reason))
+		}
+		m.resetStream(st, false)
+
+	default:
+		return fmt.Errorf("unknown record type %d", t)
+	}
+	st.cond.Broadcast()
+	return nil
+}
+
+// accepted sets up a stream the peer opened and dials its connection,
+// telling the peer once it is connected. Data that arrives meanwhile is
+// buffered within the stream's window. The caller holds mu.
+func (m *mux) accepted(id uint32, target string) {
+	if _, exists := m.streams[id]; exists || m.accept == nil || id%2 == m.nextID%2 {
+		if m.debug {
+			log.Printf("Refusing stream %d", id)
+		}
+		m.queue(muxReset, id, nil)
+		return
+	}
+	st := m.newStream(id)
+
+	go func() {
+		conn, err := m.accept(target)
+		if err != nil {
+			if m.debug {
+				log.Printf("Failed to connect stream %d to %q: %v", id, target, err)
+			}
+			m.mu.Lock()
+			var refused *refusal
+			if errors.As(err, &refused) {
+				st.reason = refused.reason
+			}
+			m.resetStream(st, true)
+			m.mu.Unlock()
+			return
+		}
+
+		m.mu.Lock()
+		if !st.reset {
+			m.queue(muxReady, id, nil)
+		}
+		m.mu.Unlock()
+
+		if st.attach(conn) && m.debug {
+			log.Printf("Accepted stream %d to %q", id, target)
+		}
+	}()
+}
+
+// requestListen asks the peer to listen on addr and open a stream back to
+// addr for each connection it accepts. The returned stream stands for the
+// listener: it becomes ready once the peer is listening, and resetting it
+// stops the listener.
+func (m *mux) requestListen(addr string) (*stream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errMuxClosed
+	}
+	st := m.newStream(m.nextID)
+	m.nextID += 2
+	m.queue(muxListen, st.id, []byte(addr))
+	return st, nil
+}
+
+// listenRequested sets up a listener the peer asked for, kept for as long
+// as its stream lasts. The caller holds mu.
+func (m *mux) listenRequested(id uint32, addr string) {
+	if _, exists := m.streams[id]; exists || m.listen == nil || id%2 == m.nextID%2 {
+		if m.debug {
+			log.Printf("Refusing listener %d on %q", id, addr)
+		}
+		m.queue(muxReset, id, []byte{resetNotAllowed})
+		return
+	}
+	st := m.newStream(id)
+
+	go func() {
+		listener, err := m.listen(addr)
+		if err != nil {
+			m.mu.Lock()
+			var refused *refusal
+			if errors.As(err, &refused) {
+				st.reason = refused.reason
+			}
+			m.resetStream(st, true)
+			m.mu.Unlock()
+			return
+		}
+
+		m.mu.Lock()
+		if !st.reset {
+			m.queue(muxReady, id, nil)
+		}
+		m.mu.Unlock()
+
+		go func() {
+			<-st.done
+			listener.Close()
+		}()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			stream, err := m.open(addr)
+			if err != nil {
+				conn.Close()
+				break
+			}
+			stream.attach(conn)
+		}
+
+		// Let the peer know the listener is gone so it can ask again
+		m.mu.Lock()
+		m.resetStream(st, true)
+		m.mu.Unlock()
+	}()
+}
+
+// resetStream discards a stream, telling the peer when notify is set. The
+// caller holds mu.
+func (m *mux) resetStream(st *stream, notify bool) {
+	if st.reset {
+		return
+	}
+	st.reset = true
+	if notify && !m.closed {
+		var payload []byte
+		if st.reason != resetFailed {
+			payload = []byte{st.reason}
+		}
+		m.queue(muxReset, st.id, payload)
+	}
+	m.remove(st)
+}
+
+// finishIfDone removes a stream once both sides have closed it and all it
+// received has been written. The caller holds mu.
+func (m *mux) finishIfDone(st *stream) {
+	if st.localClosed && st.remoteClosed && st.flushed && !st.reset {
+		st.reset = true
+		m.remove(st)
+	}
+}
+
+func (m *mux) remove(st *stream) {
+	delete(m.streams, st.id)
+	if len(m.streams) == 0 {
+		m.idleSince = time.Now()
+	}
+	if st.conn != nil {
+		st.conn.Close()
+	}
+	close(st.done)
+	st.cond.Broadcast()
+}
+
+// Close resets every stream and ends the mux
+func (m *mux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	for _, st := range m.streams {
+		m.resetStream(st, false)
+	}
+	m.cond.Broadcast()
+	return nil
+}
+
+// closeIfIdle closes the mux if it has carried no streams for at least
+// linger, reporting whether it did. Checking under the lock means a stream
+// is never opened on a mux that is being closed.
+func (m *mux) closeIfIdle(linger time.Duration) bool {
+	m.mu.Lock()
+	idle := !m.closed && len(m.streams) == 0 && time.Since(m.idleSince) >= linger
+	m.mu.Unlock()
+
+	if idle {
+		m.Close()
+	}
+	return idle
+}
+
+// readLoop sends what the connection reads to the peer, never more than the
+// peer has room for
+func (st *stream) readLoop() {
+	m := st.mux
+	buffer := make([]byte, maxRecordPayload)
+	for {
+		m.mu.Lock()
+		for st.credit == 0 && !st.reset {
+			st.cond.Wait()
+		}
+		if st.reset {
+			m.mu.Unlock()
+			return
+		}
+		size := min(st.credit, len(buffer))
+		m.mu.Unlock()
+
+		n, err := st.conn.Read(buffer[:size])
+
+		m.mu.Lock()
+		if st.reset || st.localClosed {
+			m.mu.Unlock()
+			return
+		}
+		if n > 0 {
+			st.credit -= n
+			m.queue(muxData, st.id, buffer[:n])
+		}
+		if err != nil {
+			if err == io.EOF {
+				st.localClosed = true
+				m.queue(muxClose, st.id, nil)
+				m.finishIfDone(st)
+			} else {
+				if m.debug {
+					log.Printf("Stream %d read error: %v", st.id, err)
+				}
+				m.resetStream(st, true)
+			}
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+	}
+}
+
+// writeLoop writes what the peer sent to the connection, crediting the peer
+// as it drains, and passes the peer's close on once everything is written
+func (st *stream) writeLoop() {
+	m := st.mux
+	for {
+		m.mu.Lock()
+		for len(st.inbound) == 0 && !st.remoteClosed && !st.reset {
+			st.cond.Wait()
+		}
+		if st.reset {
+			m.mu.Unlock()
+			return
+		}
+		if len(st.inbound) == 0 {
+			m.mu.Unlock()
+			st.closeWrite()
+			return
+		}
+		data := st.inbound
+		st.inbound = nil
+		st.consumed += len(data)
+		m.mu.Unlock()
+
+		_, err := st.conn.Write(data)
+
+		m.mu.Lock()
+		if err != nil {
+			if m.debug && !st.reset {
+				log.Printf("Stream %d write error: %v", st.id, err)
+			}
+			m.resetStream(st, true)
+			m.mu.Unlock()
+			return
+		}
+		if st.consumed >= streamWindow/4 && !st.reset {
+			m.queue(muxWindow, st.id, binary.BigEndian.AppendUint32(nil, uint32(st.consumed)))
+			st.consumed = 0
+		}
+		m.mu.Unlock()
+	}
+}
+
+// closeWrite passes the peer's close on to the connection. Connections that
+// cannot half-close are closed outright, which ends our side as well.
+func (st *stream) closeWrite() {
+	m := st.mux
+	if cw, ok := st.conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		m.mu.Lock()
+		st.flushed = true
+		m.finishIfDone(st)
+		m.mu.Unlock()
+		return
+	}
+
+	m.mu.Lock()
+	st.flushed = true
+	if !st.localClosed && !st.reset {
+		st.localClosed = true
+		m.queue(muxClose, st.id, nil)
+	}
+	m.finishIfDone(st)
+	m.mu.Unlock()
+	st.conn.Close()
+}
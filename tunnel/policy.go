@@ -0,0 +1,196 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DestinationPolicy decides which targets clients may open streams to, or
+// for reverse forwarding which addresses the server may listen on for them.
+// Its rules are tried in order and the first that matches decides; targets
+// no rule matches are denied.
+type DestinationPolicy struct {
+	rules []policyRule
+}
+
+// policyRule allows or denies a destination, optionally only on some ports
+// and only for one client key
+type policyRule struct {
+	line    int
+	allow   bool
+	network *net.IPNet  // set for CIDR and address rules
+	host    string      // lower-case name, "*.suffix" or "*" otherwise
+	ports   []portRange // any port when empty
+	client  string      // base64 client key, or "" for every client
+}
+
+type portRange struct {
+	low, high int
+}
+
+// LoadDestinationPolicy reads one rule per line:
+//
+//	allow|deny <destination> [ports] [client=<key>]
+//
+// The destination is a CIDR block, an address, a host name, "*.suffix" for
+// names under a domain, or "*" for anything. Ports are a comma-separated
+// list of ports and low-high ranges, or "*". Blank lines and lines starting
+// with # are skipped.
+func LoadDestinationPolicy(path string) (*DestinationPolicy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	policy := &DestinationPolicy{}
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rule, err := parsePolicyRule(strings.Fields(text))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rule.line = line
+		policy.rules = append(policy.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func parsePolicyRule(fields []string) (policyRule, error) {
+	var rule policyRule
+	if len(fields) < 2 || len(fields) > 4 {
+		return rule, fmt.Errorf("expected allow|deny <destination> [ports] [client=<key>]")
+	}
+
+	switch fields[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	dest := strings.ToLower(strings.TrimSuffix(fields[1], "."))
+	if _, network, err := net.ParseCIDR(dest); err == nil {
+		rule.network = network
+	} else if ip := net.ParseIP(dest); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if dest == "" || dest != "*" && strings.Contains(strings.TrimPrefix(dest, "*."), "*") || strings.Contains(dest, "/") {
+		return rule, fmt.Errorf("invalid destination %q", fields[1])
+	} else {
+		rule.host = dest
+	}
+
+	for _, field := range fields[2:] {
+		if key, ok := strings.CutPrefix(field, "client="); ok {
+			if rule.client != "" {
+				return rule, fmt.Errorf("more than one client key")
+			}
+			public, err := parsePublicKey(key)
+			if err != nil {
+				return rule, err
+			}
+			rule.client = base64.StdEncoding.EncodeToString(public.Bytes())
+			continue
+		}
+		if rule.ports != nil || rule.client != "" {
+			return rule, fmt.Errorf("unexpected %q", field)
+		}
+		ports, err := parsePorts(field)
+		if err != nil {
+			return rule, err
+		}
+		rule.ports = ports
+	}
+	return rule, nil
+}
+
+// parsePorts parses a list such as "22,80,8000-8100", or "*" for any port,
+// which is returned as an empty but non-nil list
+func parsePorts(list string) ([]portRange, error) {
+	ports := []portRange{}
+	if list == "*" {
+		return ports, nil
+	}
+	for _, entry := range strings.Split(list, ",") {
+		lowText, highText, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			highText = lowText
+		}
+		low, err := strconv.Atoi(lowText)
+		if err != nil || low < 1 || low > 65535 {
+			return nil, fmt.Errorf("invalid port %q", lowText)
+		}
+		high, err := strconv.Atoi(highText)
+		if err != nil || high < low || high > 65535 {
+			return nil, fmt.Errorf("invalid port range %q", entry)
+		}
+		ports = append(ports, portRange{low, high})
+	}
+	return ports, nil
+}
+
+// check returns an error naming the rule that keeps clientKey from opening
+// a stream to host, which resolved to ip, on port
+func (p *DestinationPolicy) check(clientKey, host string, ip net.IP, port int) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range p.rules {
+		if !rule.matches(clientKey, host, ip, port) {
+			continue
+		}
+		if rule.allow {
+			return nil
+		}
+		return fmt.Errorf("denied by policy rule on line %d", rule.line)
+	}
+	return fmt.Errorf("not allowed by any policy rule")
+}
+
+func (r *policyRule) matches(clientKey, host string, ip net.IP, port int) bool {
+	if r.client != "" && r.client != clientKey {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		inRange := false
+		for _, ports := range r.ports {
+			if port >= ports.low && port <= ports.high {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	switch {
+	case r.network != nil:
+		return r.network.Contains(ip)
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	default:
+		return host == r.host
+	}
+}
@@ -0,0 +1,236 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		list string
+		want []portRange
+		ok   bool
+	}{
+		{"*", []portRange{}, true},
+		{"22", []portRange{{22, 22}}, true},
+		{"22,80,8000-8100", []portRange{{22, 22}, {80, 80}, {8000, 8100}}, true},
+		{"1-65535", []portRange{{1, 65535}}, true},
+		{"0", nil, false},
+		{"65536", nil, false},
+		{"80-79", nil, false},
+		{"80-", nil, false},
+		{"-80", nil, false},
+		{"22,", nil, false},
+		{"http", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePorts(tt.list)
+		if (err == nil) != tt.ok {
+			t.Errorf("parsePorts(%q) error %v", tt.list, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePorts(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestParsePolicyRule(t *testing.T) {
+	key := generateKeyPair(t).PublicKey()
+
+	tests := []struct {
+		line string
+		want policyRule
+		ok   bool
+	}{
+		{"allow *", policyRule{allow: true, host: "*"}, true},
+		{"deny Example.COM.", policyRule{host: "example.com"}, true},
+		{"allow *.example.com 443", policyRule{allow: true, host: "*.example.com", ports: []portRange{{443, 443}}}, true},
+		{"allow 10.0.0.0/8 *", policyRule{allow: true, network: mustCIDR(t, "10.0.0.0/8"), ports: []portRange{}}, true},
+		{"deny 192.168.1.1", policyRule{network: mustCIDR(t, "192.168.1.1/32")}, true},
+		{"allow * 22 client=" + key, policyRule{allow: true, host: "*", ports: []portRange{{22, 22}}, client: key}, true},
+		{"allow * client=" + key, policyRule{allow: true, host: "*", client: key}, true},
+		{"allow", policyRule{}, false},
+		{"permit *", policyRule{}, false},
+		{"allow *.*.example.com", policyRule{}, false},
+		{"allow a*b", policyRule{}, false},
+		{"allow 10.0.0.0/33", policyRule{}, false},
+		{"allow * 22 80", policyRule{}, false},
+		{"allow * client=" + key + " 22", policyRule{}, false},
+		{"allow * client=" + key + " client=" + key, policyRule{}, false},
+		{"allow * client=nonsense", policyRule{}, false},
+		{"allow * 22 client=" + key + " extra", policyRule{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePolicyRule(strings.Fields(tt.line))
+		if (err == nil) != tt.ok {
+			t.Errorf("parsePolicyRule(%q) error %v", tt.line, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePolicyRule(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestPolicyCheck(t *testing.T) {
+	admin := generateKeyPair(t).PublicKey()
+	other := generateKeyPair(t).PublicKey()
+
+	path := filepath.Join(t.TempDir(), "policy")
+	rules := `
+# Admins reach anything on the internal network
+allow 10.0.0.0/8 * client=` + admin + `
+deny 10.0.0.0/8
+deny secret.example.com
+allow *.example.com 80,443,8000-8100
+allow 192.0.2.7 22
+`
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadDestinationPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public := net.ParseIP("198.51.100.1")
+	tests := []struct {
+		name   string
+		client string
+		host   string
+		ip     net.IP
+		port   int
+		denied string // substring of the error, or "" when allowed
+	}{
+		{"client rule", admin, "10.1.2.3", net.ParseIP("10.1.2.3"), 22, ""},
+		{"client rule for another client", other, "10.1.2.3", net.ParseIP("10.1.2.3"), 22, "line 4"},
+		{"client rule without a key", "", "10.1.2.3", net.ParseIP("10.1.2.3"), 22, "line 4"},
+		{"first match wins", admin, "secret.example.com", net.ParseIP("10.0.0.1"), 443, ""},
+		{"earlier deny", other, "secret.example.com", public, 443, "line 5"},
+		{"names resolving inside a denied network", other, "intranet.example.com", net.ParseIP("10.9.9.9"), 443, "line 4"},
+		{"suffix", other, "www.example.com", public, 443, ""},
+		{"suffix case and root", other, "WWW.Example.COM.", public, 80, ""},
+		{"nested suffix", other, "a.b.example.com", public, 80, ""},
+		{"suffix needs a label", other, "example.com", public, 443, "not allowed"},
+		{"suffix is not a substring", other, "badexample.com", public, 443, "not allowed"},
+		{"port range low", other, "www.example.com", public, 8000, ""},
+		{"port range high", other, "www.example.com", public, 8100, ""},
+		{"outside port range", other, "www.example.com", public, 8101, "not allowed"},
+		{"address rule", other, "192.0.2.7", net.ParseIP("192.0.2.7"), 22, ""},
+		{"address rule by name", other, "host.test", net.ParseIP("192.0.2.7"), 22, ""},
+		{"address rule other port", other, "192.0.2.7", net.ParseIP("192.0.2.7"), 23, "not allowed"},
+		{"default deny", other, "elsewhere.test", public, 443, "not allowed"},
+	}
+	for _, tt := range tests {
+		err := policy.check(tt.client, tt.host, tt.ip, tt.port)
+		switch {
+		case tt.denied == "" && err != nil:
+			t.Errorf("%s: denied: %v", tt.name, err)
+		case tt.denied != "" && err == nil:
+			t.Errorf("%s: allowed", tt.name)
+		case tt.denied != "" && !strings.Contains(err.Error(), tt.denied):
+			t.Errorf("%s: denied with %q, want %q", tt.name, err, tt.denied)
+		}
+	}
+
+	if err := (&DestinationPolicy{}).check("", "example.com", public, 80); err == nil {
+		t.Error("empty policy allowed a destination")
+	}
+}
+
+func TestListenReversePolicy(t *testing.T) {
+	rule, err := parsePolicyRule(strings.Fields("allow 127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewDNSServer("127.0.0.1:0", "", false)
+	server.SetReversePolicy(&DestinationPolicy{rules: []policyRule{rule}})
+
+	listener, err := server.listenReverse(1, "", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("allowed address: %v", err)
+	}
+	listener.Close()
+
+	for _, addr := range []string{":0", "0.0.0.0:0", "localhost"} {
+		_, err := server.listenReverse(1, "", addr)
+		refused, ok := err.(*refusal)
+		if !ok || refused.reason != resetNotAllowed {
+			t.Errorf("listen on %q: got %v, want a refusal", addr, err)
+		}
+	}
+}
+
+func TestDialStreamTargets(t *testing.T) {
+	dest, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := dest.Addr().String()
+
+	allowed, err := parsePolicyRule(strings.Fields("allow 127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		policy *DestinationPolicy
+		any    bool
+		target string
+		ok     bool
+	}{
+		{"default destination", nil, false, "", true},
+		{"mapping", nil, false, "web", true},
+		{"named target", nil, false, addr, false},
+		{"named datagram target", nil, false, datagramPrefix + addr, false},
+		{"any destination", nil, true, addr, true},
+		{"policy allows", &DestinationPolicy{rules: []policyRule{allowed}}, false, addr, true},
+		{"policy denies", &DestinationPolicy{}, false, addr, false},
+		{"policy denies despite any destination", &DestinationPolicy{}, true, addr, false},
+	}
+	for _, tt := range tests {
+		server := NewDNSServer("127.0.0.1:0", addr, false)
+		if err := server.AddMapping("web", addr); err != nil {
+			t.Fatal(err)
+		}
+		if tt.policy != nil {
+			server.SetDestinationPolicy(tt.policy)
+		}
+		server.SetAnyDestination(tt.any)
+
+		conn, err := server.dialStream(1, "", tt.target)
+		if conn != nil {
+			conn.Close()
+		}
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if refused, ok := err.(*refusal); !tt.ok && (!ok || refused.reason != resetNotAllowed) {
+			t.Errorf("%s: got %v, want a refusal", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// pathProfile describes how queries are shaped for a resolver path: the
+// codec for query names, the answer type asked for, the longest name that
+// arrives intact and the EDNS0 buffer size advertised
+type pathProfile struct {
+	codec      Codec
+	recordType uint16
+	nameLength int
+	udpSize    uint16
+}
+
+func (p *pathProfile) String() string {
+	return fmt.Sprintf("codec %s, %s answers, %d-byte names, %d-byte buffer",
+		p.codec.Name(), dns.Type(p.recordType), p.nameLength, p.udpSize)
+}
+
+// Candidates tried when probing, best first
+var (
+	probeRecordTypes = []uint16{dns.TypeNULL, typePrivate, dns.TypeTXT, dns.TypeAAAA, dns.TypeSRV, dns.TypeMX, dns.TypeA, dns.TypeCNAME}
+	probeNameLengths = []int{maxNameLength, 200, 150, 100}
+	probeUDPSizes    = []uint16{maxResponseSize, 1232, dns.MinMsgSize}
+)
+
+// sessionPath returns the profile for a new session, probing the resolver
+// path the first time. The result is kept once the server has answered;
+// until then sessions fail, so the path is probed again for the next one.
+func (c *DNSClient) sessionPath() (*pathProfile, error) {
+	c.pathMu.Lock()
+	defer c.pathMu.Unlock()
+
+	if c.path != nil {
+		return c.path, nil
+	}
+
+	path, answered := c.discoverPath()
+	if c.debug {
+		log.Printf("Resolver path: %v", path)
+	}
+	if !answered {
+		return nil, fmt.Errorf("no probe was answered by the server")
+	}
+	if c.chunkSize(path) < 1 {
+		return nil, fmt.Errorf("%v leaves no room for data under %s", path, c.domain)
+	}
+	c.path = path
+	return path, nil
+}
+
+// discoverPath probes for the answer type first using short names any path
+// passes, then for the longest name, the densest codec and the largest
+// answers that get through. Settings fixed by the user are not probed. It
+// also reports whether any probe was answered.
+func (c *DNSClient) discoverPath() (*pathProfile, bool) {
+	path := &pathProfile{
+		codec:      codecBase32,
+		recordType: dns.TypeTXT,
+		nameLength: maxNameLength,
+		udpSize:    dns.MinMsgSize,
+	}
+	answered := false
+
+	// try runs probes until one passes, leaving path as set by the passing
+	// candidate, or by fallback when none does
+	try := func(what string, candidates int, set func(int), fallback func(), upstream func() int, fill bool) {
+		for i := 0; i < candidates; i++ {
+			set(i)
+			ok, err := c.probe(path, upstream(), fill)
+			if err == nil {
+				answered = true
+			}
+			if ok {
+				return
+			}
+			if c.debug {
+				log.Printf("Probe for %s failed with %v: %v", what, path, err)
+			}
+		}
+		fallback()
+	}
+	none := func() int { return 0 }
+	full := func() int { return payloadSize(path.codec, c.domain, path.nameLength) - frameHeaderSize }
+
+	if c.recordType != 0 {
+		path.recordType = c.recordType
+	} else {
+		try("answer type", len(probeRecordTypes),
+			func(i int) { path.recordType = probeRecordTypes[i] },
+			func() { path.recordType = dns.TypeTXT },
+			none, false)
+	}
+
+	try("name length", len(probeNameLengths),
+		func(i int) { path.nameLength = probeNameLengths[i] },
+		func() { path.nameLength = probeNameLengths[len(probeNameLengths)-1] },
+		full, false)
+
+	if c.codec != nil {
+		path.codec = c.codec
+	} else {
+		try("codec", len(negotiableCodecs),
+			func(i int) { path.codec = negotiableCodecs[i] },
+			func() { path.codec = codecBase32 },
+			full, false)
+	}
+
+	try("buffer size", len(probeUDPSizes),
+		func(i int) { path.udpSize = probeUDPSizes[i] },
+		func() { path.udpSize = dns.MinMsgSize },
+		none, true)
+
+	return path, answered
+}
+
+// probe sends a probe frame shaped by path, carrying upstream random bytes,
+// and reports whether the answer proves the server saw exactly those bytes.
+// With fill the server pads its answer to the buffer size advertised. An
+// error means the probe never got an answer.
+func (c *DNSClient) probe(path *pathProfile, upstream int, fill bool) (bool, error) {
+	if upstream < 0 {
+		upstream = 0
+	}
+	filler := make([]byte, upstream)
+	rand.Read(filler)
+
+	f := &frame{Type: frameProbe, Session: generateSessionID(), Payload: filler}
+	if fill {
+		f.Flags |= flagFill
+	}
+	digest := sha256.Sum256(filler)
+
+	// Each extra resolver earns an attempt, since the pool may have to find
+	// out the hard way which ones are down
+	attempts := probeAttempts + len(c.resolvers.all) - 1
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var answer []byte
+		answer, _, err = c.query(path, f.marshal(), probeTimeout)
+		if _, refused := err.(rcodeError); refused {
+			// Mangled names do not decode, so the server rejects them
+			return false, nil
+		}
+		if err != nil {
+			continue
+		}
+
+		response, err := parseFrame(answer)
+		if err != nil || response.Type != frameProbe || len(response.Payload) < len(digest) {
+			return false, nil
+		}
+		return bytes.Equal(response.Payload, probeAnswer(digest[:], len(response.Payload))), nil
+	}
+	return false, err
+}
+
+// probeAnswer returns the n-byte answer to a probe whose payload had the
+// given digest: the digest itself followed by bytes derived from it, which
+// lets the client check a padded answer arrived intact
+func probeAnswer(digest []byte, n int) []byte {
+	answer := append([]byte(nil), digest...)
+	for block := uint32(0); len(answer) < n; block++ {
+		h := sha256.New()
+		h.Write(digest)
+		binary.Write(h, binary.BigEndian, block)
+		answer = h.Sum(answer)
+	}
+	return answer[:max(n, len(digest))]
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// A long zone with encryption leaves base32 names on the fallback path no
+// room for data, which must be refused up front rather than split into
+// empty chunks
+func TestLongZoneWithPSK(t *testing.T) {
+	client, err := NewDNSClient("", "127.0.0.1:53", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetPSK([]byte("secret"))
+
+	for _, zone := range []string{"tunnel.corp.example.com", strings.Repeat("a", 37)} {
+		if err := client.SetDomain(zone); err == nil {
+			t.Errorf("zone %q accepted with a PSK", zone)
+		}
+	}
+
+	// The longest zone allowed still fits a byte in the shortest names
+	zone := "tunnel.corp.example.c"
+	if err := client.SetDomain(zone); err != nil {
+		t.Fatalf("zone %q: %v", zone, err)
+	}
+	fallback := &pathProfile{codec: codecBase32, nameLength: probeNameLengths[len(probeNameLengths)-1]}
+	if size := client.chunkSize(fallback); size < 1 {
+		t.Errorf("chunk size %d for zone %q", size, zone)
+	}
+
+	// Without a key the same zones leave room
+	plain, err := NewDNSClient("", "127.0.0.1:53", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.SetDomain("tunnel.corp.example.com"); err != nil {
+		t.Errorf("zone refused without a PSK: %v", err)
+	}
+}
+
+// Sessions fail when no probe is answered instead of using the fallback
+func TestSessionPathUnanswered(t *testing.T) {
+	// A closed port refuses every query
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	client, err := NewDNSClient("", addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetPSK([]byte("secret"))
+	if err := client.SetDomain("tunnel.corp.example.c"); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := client.sessionPath(); err == nil {
+		t.Errorf("got %v with no probe answered", path)
+	}
+	if client.path != nil {
+		t.Error("unanswered path was kept")
+	}
+}
+
+func TestSplitDataIntoChunks(t *testing.T) {
+	data := []byte("abcdefg")
+	for _, size := range []int{0, -8} {
+		if chunks := splitDataIntoChunks(data, size); chunks != nil {
+			t.Errorf("size %d split into %q", size, chunks)
+		}
+	}
+	chunks := splitDataIntoChunks(data, 3)
+	if len(chunks) != 3 || string(chunks[0]) != "abc" || string(chunks[2]) != "g" {
+		t.Errorf("size 3 split into %q", chunks)
+	}
+}
@@ -0,0 +1,200 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// typePrivate carries raw answer bytes in a record type from the range
+// reserved for private use (RFC 6895)
+const typePrivate uint16 = 65399
+
+// Answer types the client may ask for. Resolvers that filter or cap TXT
+// often still pass the others.
+var recordTypes = map[string]uint16{
+	"TXT":     dns.TypeTXT,
+	"NULL":    dns.TypeNULL,
+	"CNAME":   dns.TypeCNAME,
+	"MX":      dns.TypeMX,
+	"SRV":     dns.TypeSRV,
+	"A":       dns.TypeA,
+	"AAAA":    dns.TypeAAAA,
+	"PRIVATE": typePrivate,
+}
+
+// parseRecordType returns the answer type with the given name
+func parseRecordType(name string) (uint16, error) {
+	qtype, ok := recordTypes[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported record type %q", name)
+	}
+	return qtype, nil
+}
+
+// answerCapacity returns the most frame bytes one answer of type qtype
+// under zone can carry, or 0 when only the message size limits it. A CNAME
+// is a single name, and addresses are limited by their one-byte index.
+func answerCapacity(qtype uint16, zone string) int {
+	switch qtype {
+	case dns.TypeCNAME:
+		return maxPayloadSize(codecBase32, strings.TrimSuffix(zone, "."))
+	case dns.TypeA:
+		return 256*(net.IPv4len-1) - 2
+	case dns.TypeAAAA:
+		return 256*(net.IPv6len-1) - 2
+	}
+	return 0
+}
+
+// encodeAnswer builds the records carrying payload in answer to a question
+// for name of type qtype. Names in CNAME, MX and SRV answers are base32
+// labels under zone so resolvers accept them. Unsupported types get TXT.
+func encodeAnswer(name string, qtype uint16, zone string, payload []byte) []dns.RR {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 0}
+	}
+
+	switch qtype {
+	case dns.TypeNULL:
+		return []dns.RR{&dns.NULL{Hdr: hdr(dns.TypeNULL), Data: string(payload)}}
+
+	case typePrivate:
+		return []dns.RR{&dns.RFC3597{Hdr: hdr(typePrivate), Rdata: hex.EncodeToString(payload)}}
+
+	case dns.TypeCNAME:
+		return []dns.RR{&dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: encodeName(codecBase32, payload, zone)}}
+
+	case dns.TypeMX, dns.TypeSRV:
+		// Resolvers may shuffle records, so each one carries its position
+		var records []dns.RR
+		size := maxPayloadSize(codecBase32, strings.TrimSuffix(zone, "."))
+		for i, piece := range splitDataIntoChunks(payload, size) {
+			target := encodeName(codecBase32, piece, zone)
+			if qtype == dns.TypeMX {
+				records = append(records, &dns.MX{Hdr: hdr(dns.TypeMX), Preference: uint16(i), Mx: target})
+			} else {
+				records = append(records, &dns.SRV{Hdr: hdr(dns.TypeSRV), Priority: uint16(i), Target: target})
+			}
+		}
+		return records
+
+	case dns.TypeA, dns.TypeAAAA:
+		// Each address is an index byte followed by data. The payload is
+		// prefixed with its length since the last address is padded.
+		size := net.IPv4len
+		if qtype == dns.TypeAAAA {
+			size = net.IPv6len
+		}
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(payload)))
+		framed = append(framed, payload...)
+
+		var records []dns.RR
+		for i, piece := range splitDataIntoChunks(framed, size-1) {
+			addr := make([]byte, size)
+			addr[0] = byte(i)
+			copy(addr[1:], piece)
+			if qtype == dns.TypeA {
+				records = append(records, &dns.A{Hdr: hdr(dns.TypeA), A: addr})
+			} else {
+				records = append(records, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: addr})
+			}
+		}
+		return records
+
+	default:
+		return []dns.RR{&dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: strings.Split(encodeDNSSafe(payload), ".")}}
+	}
+}
+
+// decodeAnswer extracts the payload from the records answering a question
+// of type qtype, ignoring records of other types such as CNAMEs a resolver
+// followed along the way
+func decodeAnswer(qtype uint16, zone string, answer []dns.RR) ([]byte, error) {
+	var records []dns.RR
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype {
+			records = append(records, rr)
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("response carried no %s answer", dns.Type(qtype))
+	}
+
+	switch rr := records[0].(type) {
+	case *dns.TXT:
+		return decodeDNSSafe(strings.Join(rr.Txt, ""))
+
+	case *dns.NULL:
+		return []byte(rr.Data), nil
+
+	case *dns.RFC3597:
+		return hex.DecodeString(rr.Rdata)
+
+	case *dns.CNAME:
+		return decodeTarget(rr.Target, zone)
+	}
+
+	// The remaining types are spread over several indexed records
+	type piece struct {
+		index int
+		data  []byte
+	}
+	var pieces []piece
+	for _, rr := range records {
+		switch rr := rr.(type) {
+		case *dns.MX:
+			data, err := decodeTarget(rr.Mx, zone)
+			if err != nil {
+				return nil, err
+			}
+			pieces = append(pieces, piece{int(rr.Preference), data})
+		case *dns.SRV:
+			data, err := decodeTarget(rr.Target, zone)
+			if err != nil {
+				return nil, err
+			}
+			pieces = append(pieces, piece{int(rr.Priority), data})
+		case *dns.A:
+			ip := rr.A.To4()
+			pieces = append(pieces, piece{int(ip[0]), ip[1:]})
+		case *dns.AAAA:
+			pieces = append(pieces, piece{int(rr.AAAA[0]), rr.AAAA[1:]})
+		}
+	}
+	sort.Slice(pieces, func(i, j int) bool { return pieces[i].index < pieces[j].index })
+
+	var payload []byte
+	for i, p := range pieces {
+		if p.index != i {
+			return nil, fmt.Errorf("answer is missing record %d", i)
+		}
+		payload = append(payload, p.data...)
+	}
+
+	if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+		if len(payload) < 2 {
+			return nil, fmt.Errorf("address answer too short")
+		}
+		length := int(binary.BigEndian.Uint16(payload))
+		if length > len(payload)-2 {
+			return nil, fmt.Errorf("address answer has %d of %d bytes", len(payload)-2, length)
+		}
+		payload = payload[2 : 2+length]
+	}
+	return payload, nil
+}
+
+// decodeTarget decodes the base32 labels of a name in an answer
+func decodeTarget(target, zone string) ([]byte, error) {
+	suffix := "." + dns.Fqdn(zone)
+	if len(target) <= len(suffix) || !strings.EqualFold(target[len(target)-len(suffix):], suffix) {
+		return nil, fmt.Errorf("answer name %s is outside %s", target, zone)
+	}
+	return decodeDNSSafe(target[:len(target)-len(suffix)])
+}
@@ -0,0 +1,195 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The resolver list entry standing for the nameservers in resolv.conf
+const (
+	systemResolvers = "system"
+	resolvConf      = "/etc/resolv.conf"
+)
+
+// Resolver health tuning
+const (
+	resolverFailureLimit = 3 // consecutive failures before a resolver is benched
+	minResolverBackoff   = 5 * time.Second
+	maxResolverBackoff   = time.Minute
+)
+
+// parseResolvers returns the resolver addresses in a comma-separated list.
+// Plain addresses default to port 53, and "system" expands to the
+// nameservers in /etc/resolv.conf.
+func parseResolvers(list string) ([]string, error) {
+	var servers []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+
+		case entry == systemResolvers:
+			config, err := dns.ClientConfigFromFile(resolvConf)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", resolvConf, err)
+			}
+			for _, server := range config.Servers {
+				servers = append(servers, net.JoinHostPort(server, config.Port))
+			}
+
+		case strings.Contains(entry, "://"):
+			servers = append(servers, entry)
+
+		default:
+			if _, _, err := net.SplitHostPort(entry); err != nil {
+				entry = net.JoinHostPort(entry, "53")
+			}
+			servers = append(servers, entry)
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no resolvers in %q", list)
+	}
+	return servers, nil
+}
+
+// resolver is one DNS server queries are spread over, with its health.
+// Everything but addr and transport is guarded by the pool's lock.
+type resolver struct {
+	addr      string
+	transport transport
+
+	rtt         rttEstimator
+	failureRate float64 // moving average of failed exchanges, 0 to 1
+	failures    int     // failures since the last success
+	backoff     time.Duration
+	downUntil   time.Time
+}
+
+// score ranks resolvers for the next query, lower being better. Untried
+// resolvers count as fairly fast so they get their share early on, and
+// each failure in a row doubles the score well before the bench.
+func (r *resolver) score() float64 {
+	srtt := r.rtt.srtt
+	if srtt == 0 {
+		srtt = minRTO
+	}
+	return float64(srtt) * (1 + 4*r.failureRate) * float64(int(1)<<min(r.failures, 10))
+}
+
+// resolverPool spreads queries over several resolvers, preferring fast
+// ones and benching those that keep failing, so one slow or rate-limiting
+// resolver does not stall a session. Exchanges that get no answer count as
+// failures, as does SERVFAIL, which resolvers give when rate limiting or
+// unable to reach the tunnel server; other error codes are the server's.
+type resolverPool struct {
+	mu    sync.Mutex
+	all   []*resolver
+	debug bool
+}
+
+func newResolverPool(servers []string, debug bool) *resolverPool {
+	p := &resolverPool{debug: debug}
+	for _, server := range servers {
+		p.all = append(p.all, &resolver{addr: server, transport: newTransport(server, debug)})
+	}
+	return p
+}
+
+func (p *resolverPool) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	r := p.pick()
+	resp, rtt, err := r.transport.exchange(ctx, msg)
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		p.report(r, rtt, rcodeError(resp.Rcode))
+	} else {
+		p.report(r, rtt, err)
+	}
+	if err != nil && len(p.all) > 1 {
+		return nil, rtt, fmt.Errorf("%s: %v", r.addr, err)
+	}
+	return resp, rtt, err
+}
+
+// pick returns the resolver for the next query, chosen at random among
+// the healthy ones in inverse proportion to their score, which spreads
+// load while steering most of it away from slow resolvers. When every
+// resolver is benched the one due back first is used rather than stalling.
+func (p *resolverPool) pick() *resolver {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.all) == 1 {
+		return p.all[0]
+	}
+
+	now := time.Now()
+	var healthy []*resolver
+	var total float64
+	next := p.all[0]
+	for _, r := range p.all {
+		if !now.Before(r.downUntil) {
+			healthy = append(healthy, r)
+			total += 1 / r.score()
+		}
+		if r.downUntil.Before(next.downUntil) {
+			next = r
+		}
+	}
+	if len(healthy) == 0 {
+		return next
+	}
+
+	x := rand.Float64() * total
+	for _, r := range healthy {
+		if x -= 1 / r.score(); x < 0 {
+			return r
+		}
+	}
+	return healthy[len(healthy)-1]
+}
+
+// report records the outcome of an exchange with r, benching it with a
+// growing backoff after repeated failures
+func (p *resolverPool) report(r *resolver, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		if r.backoff > 0 && p.debug {
+			log.Printf("Resolver %s recovered", r.addr)
+		}
+		r.rtt.sample(rtt)
+		r.failureRate *= 0.9
+		r.failures = 0
+		r.backoff = 0
+		return
+	}
+
+	r.failureRate = 0.9*r.failureRate + 0.1
+	r.failures++
+	if len(p.all) == 1 || time.Now().Before(r.downUntil) {
+		return
+	}
+	// A resolver back from the bench is benched again on its first failure
+	if r.failures < resolverFailureLimit && r.backoff == 0 {
+		return
+	}
+
+	r.backoff = min(max(2*r.backoff, minResolverBackoff), maxResolverBackoff)
+	r.downUntil = time.Now().Add(r.backoff)
+	r.failures = 0
+	if p.debug {
+		log.Printf("Resolver %s is unhealthy (%.0f%% failures, last: %v), benched for %v",
+			r.addr, 100*r.failureRate, err, r.backoff)
+	}
+}
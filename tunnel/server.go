@@ -24,10 +24,15 @@ SOFTWARE.
 package tunnel
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -36,21 +41,58 @@ import (
 )
 
 type Session struct {
-	conn       net.Conn
+	// Streams carried by the session, each with its own destination
+	// connection; the session reads and writes the mux's records
+	conn       io.ReadWriteCloser
 	lastActive time.Time
 	mu         sync.Mutex
 	closed     bool
-}
 
-func (s *Session) reconnect(tcpDest string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	// Seals and opens frames when a pre-shared key or identity is configured
+	cipher *sessionCipher
+
+	// Authenticated client key, and the handshake that set the session up so
+	// a retransmitted handshake gets the same reply
+	clientKey      string
+	handshake      []byte
+	handshakeReply []byte
+
+	// Set once the mux has closed; readErr records why
+	eof     bool
+	readErr error
+
+	// Upstream reordering; recvMu serializes delivery to the mux
+	recv   *recvWindow
+	recvMu sync.Mutex
+
+	// Downstream bytes not yet sequenced, and chunks held until the client
+	// acknowledges them. Chunks are cut from pending when a poll arrives so
+	// each fills the answer it goes in. sendCond throttles the pump while
+	// either is full, and ready is closed and replaced whenever new data is
+	// queued so waiting polls wake up.
+	pending  []byte
+	send     *sendWindow
+	sendMu   sync.Mutex
+	sendCond *sync.Cond
+	ready    chan struct{}
+}
 
-	// Close existing connection if any
-	if s.conn != nil {
-		s.conn.Close()
+func newSession() *Session {
+	session := &Session{
+		lastActive: time.Now(),
+		recv:       newRecvWindow(),
+		send:       newSendWindow(),
+		ready:      make(chan struct{}),
 	}
+	session.sendCond = sync.NewCond(&session.sendMu)
+	return session
+}
 
+// dialDestination connects to a stream's destination over IPv4, on
+// network "tcp" or "udp". When check is set it vets the destination once
+// resolved, before dialing. Errors are refusals carrying the reason to pass
+// on to the client.
+func dialDestination(network, tcpDest string, check func(host string, ip net.IP, port int) error) (net.Conn, error) {
 	// Force IPv4
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second,
@@ -60,12 +102,16 @@ func (s *Session) reconnect(tcpDest string) error {
 	// Resolve address to IPv4 only
 	host, port, err := net.SplitHostPort(tcpDest)
 	if err != nil {
-		return fmt.Errorf("invalid address %s: %v", tcpDest, err)
+		return nil, &refusal{resetFailed, fmt.Errorf("invalid address %s: %v", tcpDest, err)}
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, &refusal{resetFailed, fmt.Errorf("invalid port in %s", tcpDest)}
 	}
 
 	ips, err := net.LookupIP(host)
 	if err != nil {
-		return fmt.Errorf("failed to resolve %s: %v", host, err)
+		return nil, &refusal{resetUnreachable, fmt.Errorf("failed to resolve %s: %v", host, err)}
 	}
 
 	// Find first IPv4 address
@@ -78,14 +124,20 @@ func (s *Session) reconnect(tcpDest string) error {
 	}
 
 	if ipv4 == nil {
-		return fmt.Errorf("no IPv4 address found for %s", host)
+		return nil, &refusal{resetUnreachable, fmt.Errorf("no IPv4 address found for %s", host)}
+	}
+
+	if check != nil {
+		if err := check(host, ipv4, portNumber); err != nil {
+			return nil, &refusal{resetNotAllowed, err}
+		}
 	}
 
 	// Connect using IPv4 address
 	addr := net.JoinHostPort(ipv4.String(), port)
-	conn, err := dialer.Dial("tcp4", addr) // Force TCP4
+	conn, err := dialer.Dial(network+"4", addr) // Force IPv4
 	if err != nil {
-		return fmt.Errorf("reconnection failed: %v", err)
+		return nil, dialRefusal(fmt.Errorf("connection failed: %w", err))
 	}
 
 	// Set keepalive
@@ -93,10 +145,7 @@ func (s *Session) reconnect(tcpDest string) error {
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 	}
-
-	s.conn = conn
-	s.lastActive = time.Now()
-	return nil
+	return conn, nil
 }
 
 func (s *Session) Write(data []byte) error {
@@ -107,10 +156,7 @@ func (s *Session) Write(data []byte) error {
 		return fmt.Errorf("connection is nil")
 	}
 
-	// Set write deadline
-	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	defer s.conn.SetWriteDeadline(time.Time{})
-
+	// The mux only buffers, so this never waits on a destination
 	_, err := s.conn.Write(data)
 	if err != nil {
 		s.conn.Close()
@@ -122,44 +168,56 @@ func (s *Session) Write(data []byte) error {
 	return nil
 }
 
-func (s *Session) Read(buffer []byte) (int, error) {
+// pump reads the streams' records from the mux into the send window until
+// the mux closes, pausing while the window is full
+func (s *Session) pump() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	conn := s.conn
+	s.mu.Unlock()
 
-	if s.conn == nil {
-		return 0, fmt.Errorf("connection is nil")
+	if conn == nil {
+		return
 	}
 
-	// Set a short read deadline
-	s.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
-	defer s.conn.SetReadDeadline(time.Time{})
+	for {
+		s.sendMu.Lock()
+		for (len(s.pending) >= maxPendingBytes || s.send.len() >= maxReorderWindow) && !s.IsClosed() {
+			s.sendCond.Wait()
+		}
+		s.sendMu.Unlock()
 
-	n, err := s.conn.Read(buffer)
-	if err != nil {
-		if err == io.EOF {
-			// Handle EOF by closing the connection
-			s.conn.Close()
-			s.conn = nil
-			return 0, err
+		if s.IsClosed() {
+			return
 		}
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			// Timeout is normal for polling, return 0 bytes
-			return 0, nil
+
+		buffer := make([]byte, maxResponseSize)
+		n, err := conn.Read(buffer)
+
+		s.sendMu.Lock()
+		if n > 0 {
+			s.pending = append(s.pending, buffer[:n]...)
+			s.touch()
 		}
-		// Other errors should close the connection
-		s.conn.Close()
-		s.conn = nil
-		return 0, fmt.Errorf("read error: %v", err)
-	}
+		if err != nil {
+			s.mu.Lock()
+			s.eof = true
+			if err != io.EOF {
+				s.readErr = err
+			}
+			s.mu.Unlock()
+		}
+		close(s.ready)
+		s.ready = make(chan struct{})
+		s.sendMu.Unlock()
 
-	s.lastActive = time.Now()
-	return n, nil
+		if err != nil {
+			return
+		}
+	}
 }
 
 func (s *Session) Close() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if !s.closed {
 		s.closed = true
 		if s.conn != nil {
@@ -167,6 +225,93 @@ func (s *Session) Close() {
 			s.conn = nil
 		}
 	}
+	s.mu.Unlock()
+
+	// Wake the pump if it is waiting for window space
+	s.sendMu.Lock()
+	s.sendCond.Broadcast()
+	s.sendMu.Unlock()
+}
+
+// deliver passes an upstream chunk through the reorder buffer and writes
+// whatever is now in order to the mux. It returns the ack to send
+// and whether the chunk was accepted rather than dropped as too far ahead.
+func (s *Session) deliver(seq uint16, data []byte) (uint16, bool, error) {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	ready, accepted := s.recv.push(seq, data)
+	for _, chunk := range ready {
+		if len(chunk) == 0 || s.destinationClosed() {
+			// Nothing left to write to once the mux is gone
+			continue
+		}
+		if err := s.Write(chunk); err != nil {
+			return s.recv.ack(), accepted, err
+		}
+	}
+	return s.recv.ack(), accepted, nil
+}
+
+// nextChunk returns the next downstream segment to send: one whose answer
+// is overdue, or else a new one of at most budget bytes cut from the pending
+// data. The caller holds sendMu.
+func (s *Session) nextChunk(budget int) *segment {
+	if seg := s.send.nextToSend(); seg != nil {
+		return seg
+	}
+	if len(s.pending) == 0 || s.send.len() >= maxReorderWindow {
+		return nil
+	}
+
+	n := len(s.pending)
+	if n > budget {
+		n = budget
+	}
+	data := make([]byte, n)
+	copy(data, s.pending)
+	s.pending = s.pending[n:]
+	s.send.add(data)
+
+	// Wake the pump in case it was waiting for pending to drain
+	s.sendCond.Broadcast()
+	return s.send.nextToSend()
+}
+
+// ackSeq returns the highest contiguous upstream sequence delivered
+func (s *Session) ackSeq() uint16 {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	return s.recv.ack()
+}
+
+// acknowledge releases downstream chunks the client has received and wakes
+// the pump if that freed window space
+func (s *Session) acknowledge(ack uint16) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.send.acknowledge(ack)
+	s.sendCond.Broadcast()
+}
+
+// destinationClosed reports whether the mux has closed
+func (s *Session) destinationClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.eof
+}
+
+func (s *Session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+}
+
+func (s *Session) lastActivity() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastActive
 }
 
 func (s *Session) IsClosed() bool {
@@ -178,323 +323,860 @@ func (s *Session) IsClosed() bool {
 type DNSServer struct {
 	dnsListener            string
 	tcpDest                string
-	sessions               map[string]*Session
+	mappings               map[string]string
+	policy                 *DestinationPolicy
+	anyDestination         bool
+	reversePolicy          *DestinationPolicy
+	domain                 string
+	zoneRecords            ZoneRecords
+	authority              *authority
+	upstream               string
+	tlsListener            string
+	tlsConfig              *tls.Config
+	sessions               map[uint32]*Session
 	mu                     sync.Mutex
+	psk                    []byte
+	pskMu                  sync.Mutex
+	pskCiphers             map[pskSessionKey]*sessionCipher
+	identity               *KeyPair
+	authorizedKeys         AuthorizedKeys
 	debug                  bool
 	sessionCleanupInterval time.Duration
 }
 
+// pskSessionKey identifies the cipher of a pre-shared key session
+type pskSessionKey struct {
+	session uint32
+	salt    [envelopeSaltSize]byte
+}
+
 func NewDNSServer(dnsListener, tcpDest string, debug bool) *DNSServer {
 	return &DNSServer{
 		dnsListener: dnsListener,
 		tcpDest:     tcpDest,
-		sessions:    make(map[string]*Session),
+		mappings:    make(map[string]string),
+		sessions:    make(map[uint32]*Session),
+		pskCiphers:  make(map[pskSessionKey]*sessionCipher),
 		mu:          sync.Mutex{},
 		debug:       debug,
 	}
 }
 
+// SetDomain makes the server answer tunnel queries under a delegated zone
+// such as "t.example.com" and refuse names outside it
+func (s *DNSServer) SetDomain(domain string) {
+	s.domain = normalizeDomain(domain)
+}
+
+// SetZoneRecords sets the SOA, NS and address records served for the
+// tunnel domain. It only takes effect together with SetDomain.
+func (s *DNSServer) SetZoneRecords(records ZoneRecords) {
+	s.zoneRecords = records
+}
+
+// SetUpstream relays questions outside the tunnel domain to a recursive
+// resolver instead of refusing them. It only takes effect together with
+// SetDomain.
+func (s *DNSServer) SetUpstream(addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	s.upstream = addr
+}
+
+// payloadLabels strips the tunnel domain from a query name, returning false
+// for names outside it. Without a domain the last label is treated as a
+// fake TLD. Labels are split with escapes in mind since raw payloads may
+// contain escaped dots.
+func (s *DNSServer) payloadLabels(name string) (string, bool) {
+	name = dns.Fqdn(name)
+	labels := dns.Split(name)
+
+	zoneLabels := 1
+	if s.domain != "" {
+		zoneLabels = dns.CountLabel(s.domain)
+	}
+	if len(labels) <= zoneLabels {
+		return "", false
+	}
+
+	start := labels[len(labels)-zoneLabels]
+	if s.domain != "" && !strings.EqualFold(name[start:], s.domain+".") {
+		return "", false
+	}
+	return name[:start-1], true
+}
+
+// SetTLS also serves DNS over TLS (RFC 7858) on addr, such as
+// "0.0.0.0:853", with the certificate and key in the given PEM files
+func (s *DNSServer) SetTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	s.tlsListener = addr
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// SetPSK requires every frame to be sealed with a key shared with clients
+func (s *DNSServer) SetPSK(psk []byte) {
+	s.psk = psk
+}
+
+// SetIdentity requires clients to complete a handshake with this server
+// key, admitting only clients whose public key is in authorizedKeys
+func (s *DNSServer) SetIdentity(identity *KeyPair, authorizedKeys AuthorizedKeys) {
+	s.identity = identity
+	s.authorizedKeys = authorizedKeys
+}
+
+// AddMapping lets clients open streams to dest by name, such as "ssh" for
+// "127.0.0.1:22", so one server can front several services. Mapped
+// destinations are chosen by the operator and bypass the policy.
+func (s *DNSServer) AddMapping(name, dest string) error {
+	if !isMappingName(name) {
+		return fmt.Errorf("invalid mapping name %q", name)
+	}
+	if _, exists := s.mappings[name]; exists {
+		return fmt.Errorf("mapping %q is defined twice", name)
+	}
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		return fmt.Errorf("invalid destination for %s: %v", name, err)
+	}
+	s.mappings[name] = dest
+	return nil
+}
+
+// SetDestinationPolicy vets the targets clients name when opening streams,
+// as SOCKS5 and HTTP proxy connections do. Without a policy such targets
+// are refused unless SetAnyDestination allows them. The default
+// destination and mappings are always allowed.
+func (s *DNSServer) SetDestinationPolicy(policy *DestinationPolicy) {
+	s.policy = policy
+}
+
+// SetAnyDestination lets clients open streams to targets they name, as
+// SOCKS5 and HTTP proxy connections do, even without a destination policy.
+// Otherwise they may only reach the default destination and mappings.
+func (s *DNSServer) SetAnyDestination(allowed bool) {
+	s.anyDestination = allowed
+}
+
+// SetReversePolicy lets clients ask the server to listen on the addresses
+// policy allows and carry the connections back to them, like ssh -R. An
+// address without a host is checked as 0.0.0.0.
+func (s *DNSServer) SetReversePolicy(policy *DestinationPolicy) {
+	s.reversePolicy = policy
+}
+
 func (s *DNSServer) Start() error {
+	// Answer for the zone itself when running as its nameserver
+	if s.domain != "" {
+		s.authority = newAuthority(s.domain, s.zoneRecords)
+	}
+
 	// Start session cleanup goroutine
 	go s.cleanupSessions()
 
-	dns.HandleFunc(".", s.handleDNSRequest)
-	server := &dns.Server{Addr: s.dnsListener, Net: "udp"}
+	// Serve TCP as well for answers too large for UDP and for networks that
+	// only pass DNS over TCP
+	handler := dns.HandlerFunc(s.handleDNSRequest)
+	servers := []*dns.Server{
+		{Addr: s.dnsListener, Net: "udp", Handler: handler},
+		{Addr: s.dnsListener, Net: "tcp", Handler: handler},
+	}
+	if s.tlsConfig != nil {
+		servers = append(servers, &dns.Server{Addr: s.tlsListener, Net: "tcp-tls", TLSConfig: s.tlsConfig, Handler: handler})
+	}
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
 
 	if s.debug {
-		log.Printf("DNS server starting on %s (UDP)", s.dnsListener)
+		log.Printf("DNS server starting on %s (UDP and TCP)", s.dnsListener)
+		if s.tlsConfig != nil {
+			log.Printf("DNS over TLS server starting on %s", s.tlsListener)
+		}
+	}
+
+	return <-errs
+}
+
+// responseLimit returns the largest response that can answer r: the
+// requester's EDNS0 buffer size, or 512 bytes without an OPT record, over
+// UDP, and the DNS message limit over stream transports
+func responseLimit(w dns.ResponseWriter, r *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return dns.MaxMsgSize
+	}
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+// sessionAuth is what a new session learned while being authenticated
+type sessionAuth struct {
+	cipher         *sessionCipher
+	clientKey      string
+	handshake      []byte
+	handshakeReply []byte
+}
+
+// zoneOf returns the zone part of a tunnel query name, which names in
+// answers are built under
+func (s *DNSServer) zoneOf(name string) string {
+	name = dns.Fqdn(name)
+	labels, _ := s.payloadLabels(name)
+	return name[len(labels)+1:]
+}
+
+// dataBudget returns how many destination bytes fit in a DATA frame sent in
+// msg, the response being built for request r. Over UDP the limit is the
+// requester's EDNS0 buffer size, or the classic 512 bytes when it sent no
+// OPT record; over TCP answers may be larger.
+func (s *DNSServer) dataBudget(w dns.ResponseWriter, r, msg *dns.Msg, question dns.Question, sealed bool) int {
+	size := responseLimit(w, r)
+	ceiling := maxStreamResponseSize
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		ceiling = maxResponseSize
+	}
+	if size > ceiling {
+		size = ceiling
+	}
+
+	overhead := frameHeaderSize
+	if sealed {
+		overhead += envelopeOverhead
+	}
+
+	zone := s.zoneOf(question.Name)
+	limit := size
+	if capacity := answerCapacity(question.Qtype, zone); capacity > 0 {
+		limit = capacity - overhead
+	}
+
+	// Find the largest payload whose answer still fits. Trial payloads are
+	// random so names in the answer compress no better than real ones.
+	trial := make([]byte, overhead+limit)
+	rand.Read(trial)
+	answered := len(msg.Answer)
+	fits := func(n int) bool {
+		msg.Answer = append(msg.Answer[:answered], encodeAnswer(question.Name, question.Qtype, zone, trial[:overhead+n])...)
+		return msg.Len() <= size
+	}
+	low, high := 0, limit
+	for low < high {
+		mid := (low + high + 1) / 2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
 	}
+	msg.Answer = msg.Answer[:answered]
 
-	return server.ListenAndServe()
+	// Always make progress, even if the answer ends up truncated
+	if low < 1 {
+		low = 1
+	}
+	return low
 }
 
-func (s *DNSServer) getSession(sessionID string) (*Session, error) {
+func (s *DNSServer) getSession(sessionID uint32, auth *sessionAuth) (*Session, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	session, exists := s.sessions[sessionID]
-	if !exists || session.conn == nil {
+	if !exists {
 		// Create new session with connection
-		session = &Session{
-			lastActive: time.Now(),
+		session = newSession()
+		if auth != nil {
+			session.cipher = auth.cipher
+			session.clientKey = auth.clientKey
+			session.handshake = auth.handshake
+			session.handshakeReply = auth.handshakeReply
 		}
 
-		// Connect using IPv4
-		if err := session.reconnect(s.tcpDest); err != nil {
-			return nil, err
+		// Each stream the client opens gets its own destination connection
+		clientKey := session.clientKey
+		m := newMux(false, func(target string) (net.Conn, error) {
+			return s.dialStream(sessionID, clientKey, target)
+		}, s.debug)
+		if s.reversePolicy != nil {
+			m.listen = func(addr string) (net.Listener, error) {
+				return s.listenReverse(sessionID, clientKey, addr)
+			}
 		}
+		session.conn = m
+		go session.pump()
 
 		s.sessions[sessionID] = session
 
 		if s.debug {
-			log.Printf("Created new connection for session %s to %s", sessionID, s.tcpDest)
+			log.Printf("Created session %08x for streams to %s", sessionID, s.tcpDest)
 		}
 	}
 
 	return session, nil
 }
 
-func (s *DNSServer) handlePoll(session *Session) ([]byte, error) {
-	if session == nil || session.IsClosed() {
-		return []byte("CLOSED"), nil
+// dialStream connects a stream a client opened to target: the configured
+// destination when target is empty, the destination of a named mapping,
+// or otherwise the host:port named, over UDP for a datagram stream, if the
+// server allows targets named by clients and its policy allows this one
+func (s *DNSServer) dialStream(sessionID uint32, clientKey, target string) (net.Conn, error) {
+	if target == "" {
+		if s.tcpDest == "" {
+			return nil, &refusal{resetNotAllowed, fmt.Errorf("no destination configured")}
+		}
+		return dialDestination("tcp", s.tcpDest, nil)
+	}
+
+	if isMappingName(target) {
+		dest, ok := s.mappings[target]
+		if !ok {
+			log.Printf("Session %08x asked for unknown mapping %q", sessionID, target)
+			return nil, &refusal{resetNotAllowed, fmt.Errorf("no mapping named %q", target)}
+		}
+		return dialDestination("tcp", dest, nil)
 	}
 
-	buffer := make([]byte, maxChunkSize)
+	network := "tcp"
+	if dest, ok := strings.CutPrefix(target, datagramPrefix); ok {
+		network, target = "udp", dest
+	}
+	if s.policy == nil && !s.anyDestination {
+		log.Printf("Session %08x denied %s stream to %s: no destination policy", sessionID, network, target)
+		return nil, &refusal{resetNotAllowed, fmt.Errorf("targets named by clients are not allowed")}
+	}
 
-	session.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
-	defer session.conn.SetReadDeadline(time.Time{})
+	var check func(host string, ip net.IP, port int) error
+	if s.policy != nil {
+		check = func(host string, ip net.IP, port int) error {
+			err := s.policy.check(clientKey, host, ip, port)
+			if err != nil {
+				log.Printf("Session %08x denied %s stream to %s (%s): %v", sessionID, network, target, ip, err)
+			}
+			return err
+		}
+	}
+	conn, err := dialDestination(network, target, check)
+	if err != nil || network == "tcp" {
+		return conn, err
+	}
+	return newDatagramConn(conn.(*net.UDPConn)), nil
+}
 
-	n, err := session.conn.Read(buffer)
+// listenReverse opens a listener a client asked for, if the reverse policy
+// allows it, whose connections are carried back to the client to be dialed
+// on its network
+func (s *DNSServer) listenReverse(sessionID uint32, clientKey, addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		if err == io.EOF || strings.Contains(err.Error(), "connection reset") {
-			session.Close()
-			return []byte("CLOSED"), nil
-		}
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return []byte("EMPTY"), nil
-		}
+		log.Printf("Session %08x denied listening on %q: %v", sessionID, addr, err)
+		return nil, &refusal{resetNotAllowed, err}
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		log.Printf("Session %08x could not listen on %s: %v", sessionID, addr, err)
 		return nil, err
 	}
-
-	if n == 0 {
-		return []byte("EMPTY"), nil
+	ip := tcpAddr.IP
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	if err := s.reversePolicy.check(clientKey, host, ip, tcpAddr.Port); err != nil {
+		log.Printf("Session %08x denied listening on %s (%s): %v", sessionID, addr, ip, err)
+		return nil, &refusal{resetNotAllowed, err}
 	}
 
-	return buffer[:n], nil
+	// Listen on the address checked rather than resolving the name again
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		log.Printf("Session %08x could not listen on %s: %v", sessionID, addr, err)
+		return nil, err
+	}
+	log.Printf("Session %08x listening on %s for reverse forwarding", sessionID, addr)
+	return listener, nil
 }
 
-func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	if len(r.Question) == 0 {
-		return
+// openFrame authenticates and parses a query payload. It also returns the
+// cipher answers must be sealed with, which is nil for plaintext frames.
+// Once a key or identity is configured only handshakes and probes may
+// travel unsealed.
+func (s *DNSServer) openFrame(payload []byte) (*frame, *sessionCipher, error) {
+	keyed := s.psk != nil || s.identity != nil
+
+	if !isEnvelope(payload) {
+		f, err := parseFrame(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		if keyed && f.Type != frameHandshake && f.Type != frameProbe {
+			return nil, nil, fmt.Errorf("unsealed %s frame", frameTypeName(f.Type))
+		}
+		return f, nil, nil
 	}
 
-	question := r.Question[0]
-	if s.debug {
-		log.Printf("=== Received DNS Request ===")
-		log.Printf("From: %s", w.RemoteAddr().String())
-		log.Printf("Raw message: %v", r.String())
-		log.Printf("Question: %s (type: %d)", question.Name, question.Qtype)
+	if !keyed {
+		return nil, nil, fmt.Errorf("sealed frame but no key is configured")
 	}
 
-	// Create response message
-	msg := new(dns.Msg)
-	msg.SetReply(r)
+	sessionID, salt, err := parseEnvelopeHeader(payload)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Set EDNS0 options for larger responses
-	if opt := r.IsEdns0(); opt != nil {
-		msg.SetEdns0(opt.UDPSize(), opt.Do())
-	} else {
-		msg.SetEdns0(4096, false)
+	cipher, plaintext, err := s.openEnvelope(sessionID, salt, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := parseFrame(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.Session != sessionID {
+		return nil, nil, fmt.Errorf("frame for session %08x sealed for %08x", f.Session, sessionID)
 	}
+	return f, cipher, nil
+}
 
-	// Parse the DNS question
-	parts := strings.Split(strings.TrimSuffix(question.Name, "."), ".")
+// openEnvelope opens an envelope with the cipher of an existing session, or
+// with one derived from the pre-shared key for a session that has not been
+// created yet. With an identity configured, sessions only get a cipher by
+// handshaking.
+func (s *DNSServer) openEnvelope(sessionID uint32, salt, envelope []byte) (*sessionCipher, []byte, error) {
+	s.mu.Lock()
+	session, exists := s.sessions[sessionID]
+	s.mu.Unlock()
 
-	// Validate parts length
-	if len(parts) < 4 {
-		if s.debug {
-			log.Printf("Invalid request format: not enough parts")
+	if exists && session.cipher != nil {
+		if !bytes.Equal(session.cipher.salt, salt) {
+			return nil, nil, fmt.Errorf("salt mismatch for session %08x", sessionID)
 		}
-		msg.Rcode = dns.RcodeFormatError
-		w.WriteMsg(msg)
-		return
+		plaintext, err := session.cipher.open(envelope)
+		return session.cipher, plaintext, err
+	}
+	if s.identity != nil {
+		return nil, nil, fmt.Errorf("no handshake for session %08x", sessionID)
 	}
+	return s.openPSK(sessionID, salt, envelope)
+}
 
-	// Extract parts in reverse order since DNS names are right-to-left
-	tld := parts[len(parts)-1]
-	sessionID := parts[len(parts)-2]
-	sequence := parts[len(parts)-3]
+// openPSK opens an envelope for a pre-shared key session the server holds
+// no session for. The key follows from the session ID and salt alone, so
+// the cipher, with its replay window, is kept for as long as its salt is
+// accepted; otherwise frames replayed once the session was cleaned up
+// would open a fresh one. The lock is held while opening so concurrent
+// first frames share one cipher.
+func (s *DNSServer) openPSK(sessionID uint32, salt, envelope []byte) (*sessionCipher, []byte, error) {
+	if age := time.Since(pskSaltTime(salt)); age > pskSaltMaxAge || age < -pskSaltMaxAge {
+		return nil, nil, fmt.Errorf("salt for session %08x is %v from the server's clock", sessionID, age.Round(time.Second))
+	}
 
-	// Combine all remaining parts as the encoded data
-	encodedData := strings.Join(parts[:len(parts)-3], ".")
+	key := pskSessionKey{session: sessionID, salt: [envelopeSaltSize]byte(salt)}
+	s.pskMu.Lock()
+	defer s.pskMu.Unlock()
 
-	if s.debug {
-		log.Printf("Parsed request:")
-		log.Printf("  Encoded data: %s", encodedData)
-		log.Printf("  Sequence: %s", sequence)
-		log.Printf("  Session ID: %s", sessionID)
-		log.Printf("  TLD: %s", tld)
+	cipher, known := s.pskCiphers[key]
+	if !known {
+		var err error
+		cipher, err = newPSKCipher(s.psk, sessionID, salt, false)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// Get or create session
-	session, err := s.getSession(sessionID)
+	plaintext, err := cipher.open(envelope)
 	if err != nil {
-		if s.debug {
-			log.Printf("Failed to get/create session: %v", err)
+		return nil, nil, err
+	}
+	// Only authenticated salts are remembered
+	s.pskCiphers[key] = cipher
+	return cipher, plaintext, nil
+}
+
+// forgetPSKCiphers drops the ciphers of salts too old to be accepted
+func (s *DNSServer) forgetPSKCiphers() {
+	s.pskMu.Lock()
+	defer s.pskMu.Unlock()
+	for key := range s.pskCiphers {
+		if time.Since(pskSaltTime(key.salt[:])) > pskSaltMaxAge {
+			delete(s.pskCiphers, key)
 		}
-		msg.Rcode = dns.RcodeServerFailure
-		w.WriteMsg(msg)
-		return
+	}
+}
+
+// handleHandshake authenticates a client and creates its session, refusing
+// unknown keys before anything is dialed. A retransmitted handshake gets the
+// original reply again.
+func (s *DNSServer) handleHandshake(f *frame) (*frame, error) {
+	if s.identity == nil {
+		return nil, fmt.Errorf("handshakes are not enabled")
 	}
 
-	// Handle the request
-	isPoll := sequence == "ffff"
-	var responseText string
+	s.mu.Lock()
+	session, exists := s.sessions[f.Session]
+	s.mu.Unlock()
 
-	if isPoll {
-		response, err := s.handlePoll(session)
+	if !exists {
+		reply, cipher, clientKey, err := respondHandshake(s.identity, f.Session, s.psk, f.Payload)
 		if err != nil {
-			if s.debug {
-				log.Printf("Poll error: %v", err)
-			}
-			msg.Rcode = dns.RcodeServerFailure
-			w.WriteMsg(msg)
-			return
+			return nil, err
 		}
 
-		if response == nil || len(response) == 0 {
-			msg.Answer = append(msg.Answer, &dns.TXT{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeTXT,
-					Class:  dns.ClassINET,
-					Ttl:    0,
-				},
-				Txt: []string{"EMPTY"},
-			})
-		} else {
-			// Encode the response data properly
-			encoded := encodeDNSSafe(response)
-			chunks := strings.Split(encoded, ".")
-
-			txt := &dns.TXT{
-				Hdr: dns.RR_Header{
-					Name:   question.Name,
-					Rrtype: dns.TypeTXT,
-					Class:  dns.ClassINET,
-					Ttl:    0,
-				},
-				Txt: chunks,
-			}
-			msg.Answer = append(msg.Answer, txt)
+		comment, authorized := s.authorizedKeys[clientKey]
+		if !authorized {
+			return nil, fmt.Errorf("client key %s is not authorized", clientKey)
+		}
 
-			if s.debug {
-				log.Printf("Sending response with %d chunks", len(chunks))
-			}
+		if s.debug {
+			log.Printf("Authenticated client %s (%s) for session %08x", clientKey, comment, f.Session)
 		}
-		w.WriteMsg(msg)
-		return
-	} else {
-		// Handle regular data
-		decodedData, err := decodeDNSSafe(encodedData)
+
+		session, err = s.getSession(f.Session, &sessionAuth{
+			cipher:         cipher,
+			clientKey:      clientKey,
+			handshake:      f.Payload,
+			handshakeReply: reply,
+		})
 		if err != nil {
-			if s.debug {
-				log.Printf("Failed to decode data: %v", err)
-			}
-			msg.Rcode = dns.RcodeFormatError
-			w.WriteMsg(msg)
-			return
+			return nil, err
 		}
+	}
 
-		if len(decodedData) > 0 {
-			if s.debug {
-				log.Printf("Writing %d bytes to connection", len(decodedData))
+	// Also covers losing a race with a duplicate of this handshake
+	if !bytes.Equal(session.handshake, f.Payload) {
+		return nil, fmt.Errorf("session %08x is already established", f.Session)
+	}
+	return &frame{Type: frameHandshake, Session: f.Session, Payload: session.handshakeReply}, nil
+}
+
+// closeSession tears down a session at the client's request
+func (s *DNSServer) closeSession(sessionID uint32) {
+	s.mu.Lock()
+	session, exists := s.sessions[sessionID]
+	s.mu.Unlock()
+
+	if exists {
+		session.Close()
+	}
+}
+
+// handlePoll returns the frame answering a poll: DATA when the streams
+// have bytes for us, KEEPALIVE when they have none, and FIN once the mux has
+// closed and everything sent has been acknowledged. Downstream data stays queued
+// until a later poll acknowledges it, so a lost answer is replayed once its
+// retransmission timeout passes. Several polls may be in flight at once;
+// each one takes the next chunk that is due. New chunks carry up to budget
+// bytes so they fill the answer.
+func (s *DNSServer) handlePoll(session *Session, sessionID uint32, budget int) *frame {
+	if session == nil || session.IsClosed() {
+		return &frame{Type: frameFin, Session: sessionID}
+	}
+
+	deadline := time.NewTimer(pollWait)
+	defer deadline.Stop()
+
+	for {
+		session.sendMu.Lock()
+		seg := session.nextChunk(budget)
+		pending := session.send.len() + len(session.pending)
+		ready := session.ready
+		session.sendMu.Unlock()
+
+		if seg != nil {
+			if s.debug && seg.retries > 0 {
+				log.Printf("Replaying downstream chunk %d for session %08x", seg.seq, sessionID)
 			}
+			return &frame{Type: frameData, Session: sessionID, Seq: seg.seq, Ack: session.ackSeq(), Payload: seg.data}
+		}
 
-			if err := session.Write(decodedData); err != nil {
+		if pending == 0 && session.destinationClosed() {
+			// Drained and acknowledged, so the close can go out now
+			session.mu.Lock()
+			readErr := session.readErr
+			session.mu.Unlock()
+
+			session.Close()
+			if readErr != nil && !strings.Contains(readErr.Error(), "connection reset") {
 				if s.debug {
-					log.Printf("Failed to write to connection: %v", err)
+					log.Printf("Read error on session %08x: %v", sessionID, readErr)
 				}
-				msg.Rcode = dns.RcodeServerFailure
-				w.WriteMsg(msg)
-				return
+				return &frame{Type: frameRst, Session: sessionID}
 			}
+			return &frame{Type: frameFin, Session: sessionID}
+		}
+
+		// Hold the poll briefly in case a destination is about to answer
+		select {
+		case <-ready:
+		case <-deadline.C:
+			return &frame{Type: frameKeepalive, Session: sessionID, Ack: session.ackSeq()}
+		}
+	}
+}
+
+// answerNonTunnel answers a name under the tunnel domain that does not carry
+// a frame. As an authoritative server, names that could be partial tunnel
+// names get an empty answer and anything else is NXDOMAIN.
+func (s *DNSServer) answerNonTunnel(w dns.ResponseWriter, msg *dns.Msg, labels string) {
+	switch {
+	case s.authority == nil:
+		msg.Rcode = dns.RcodeFormatError
+	case matchesTunnelPattern(labels):
+		s.authority.nodata(msg)
+	default:
+		s.authority.nxdomain(msg)
+	}
+	w.WriteMsg(msg)
+}
+
+// forward relays a question to the upstream resolver and passes its answer
+// back, retrying over TCP when the upstream answer is truncated
+func (s *DNSServer) forward(w dns.ResponseWriter, r *dns.Msg) {
+	if s.debug {
+		log.Printf("Forwarding %s to %s", r.Question[0].Name, s.upstream)
+	}
+
+	client := &dns.Client{Net: "udp", Timeout: dnsTimeout}
+	reply, _, err := client.Exchange(r, s.upstream)
+	if err == nil && reply.Truncated {
+		client.Net = "tcp"
+		reply, _, err = client.Exchange(r, s.upstream)
+	}
+	if err != nil {
+		if s.debug {
+			log.Printf("Upstream query failed: %v", err)
 		}
-		responseText = "EMPTY"
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(msg)
+		return
 	}
 
-	// Split response into smaller chunks if needed
-	const maxResponseChunkSize = 180 // Smaller response chunks
+	// An answer fetched over TCP may not fit the client's UDP buffer
+	reply.Truncate(responseLimit(w, r))
+	w.WriteMsg(reply)
+}
 
-	if len(responseText) > maxResponseChunkSize {
-		chunks := make([]string, 0)
-		for i := 0; i < len(responseText); i += maxResponseChunkSize {
-			end := i + maxResponseChunkSize
-			if end > len(responseText) {
-				end = len(responseText)
+// writeFrame seals and encodes a frame into an answer of the type asked for
+// and sends the response
+func (s *DNSServer) writeFrame(w dns.ResponseWriter, msg *dns.Msg, question dns.Question, cipher *sessionCipher, f *frame) {
+	payload := f.marshal()
+	if cipher != nil {
+		var err error
+		if payload, err = cipher.seal(payload); err != nil {
+			if s.debug {
+				log.Printf("Failed to seal frame: %v", err)
 			}
-			chunks = append(chunks, responseText[i:end])
-		}
-		txt := &dns.TXT{
-			Hdr: dns.RR_Header{
-				Name:   question.Name,
-				Rrtype: dns.TypeTXT,
-				Class:  dns.ClassINET,
-				Ttl:    0,
-			},
-			Txt: chunks,
-		}
-		msg.Answer = append(msg.Answer, txt)
-	} else {
-		txt := &dns.TXT{
-			Hdr: dns.RR_Header{
-				Name:   question.Name,
-				Rrtype: dns.TypeTXT,
-				Class:  dns.ClassINET,
-				Ttl:    0,
-			},
-			Txt: []string{responseText},
-		}
-		msg.Answer = append(msg.Answer, txt)
+			msg.Rcode = dns.RcodeServerFailure
+			w.WriteMsg(msg)
+			return
+		}
+	}
+
+	records := encodeAnswer(question.Name, question.Qtype, s.zoneOf(question.Name), payload)
+	msg.Answer = append(msg.Answer, records...)
+
+	// A replayed chunk cut for a larger answer may not fit; setting TC tells
+	// the client to ask again over TCP
+	if limit := responseLimit(w, msg); msg.Len() > limit {
+		msg.Truncate(limit)
+		if s.debug {
+			log.Printf("Truncated %s frame for session %08x to %d bytes", frameTypeName(f.Type), f.Session, limit)
+		}
 	}
 
 	if s.debug {
-		log.Printf("Sending response with %d chunks", len(msg.Answer[0].(*dns.TXT).Txt))
+		log.Printf("Sending %s frame for session %08x (%d bytes, %d %s records)",
+			frameTypeName(f.Type), f.Session, len(f.Payload), len(records), dns.Type(records[0].Header().Rrtype))
 	}
 
 	w.WriteMsg(msg)
 }
 
-func (s *DNSServer) createSession(sessionID string) (*Session, error) {
-	// Force IPv4
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		DualStack: false, // Disable IPv6
+func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		return
 	}
 
-	// Resolve address to IPv4 only
-	host, port, err := net.SplitHostPort(s.tcpDest)
-	if err != nil {
-		return nil, fmt.Errorf("invalid address %s: %v", s.tcpDest, err)
+	question := r.Question[0]
+	if s.debug {
+		log.Printf("=== Received DNS Request ===")
+		log.Printf("From: %s", w.RemoteAddr().String())
+		log.Printf("Raw message: %v", r.String())
+		log.Printf("Question: %s (type: %d)", question.Name, question.Qtype)
 	}
 
-	ips, err := net.LookupIP(host)
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+	// Create response message
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+
+	// Answers spread over many records repeat the question name in each
+	msg.Compress = true
+
+	// Echo EDNS0 only to requesters that sent it, since the OPT record in
+	// the request decides how large the answer may be
+	if opt := r.IsEdns0(); opt != nil {
+		msg.SetEdns0(opt.UDPSize(), opt.Do())
 	}
 
-	// Find first IPv4 address
-	var ipv4 net.IP
-	for _, ip := range ips {
-		if ip.To4() != nil {
-			ipv4 = ip
-			break
+	// Questions about the zone apex and its nameservers
+	if s.authority != nil && s.authority.answer(msg, question) {
+		w.WriteMsg(msg)
+		return
+	}
+
+	// Parse the DNS question: [<codec tag>.]<frame labels>.<domain>
+	labels, ok := s.payloadLabels(question.Name)
+	if !ok && s.domain != "" && s.upstream != "" {
+		s.forward(w, r)
+		return
+	}
+	if !ok {
+		if s.debug {
+			log.Printf("Refusing name outside the tunnel domain: %s", question.Name)
 		}
+		msg.Rcode = dns.RcodeRefused
+		w.WriteMsg(msg)
+		return
 	}
 
-	if ipv4 == nil {
-		return nil, fmt.Errorf("no IPv4 address found for %s", host)
+	codec, encodedData := splitCodec(labels)
+	decodedData, err := codec.Decode(encodedData)
+	if err == nil && !isEnvelope(decodedData) {
+		_, err = parseFrame(decodedData)
+	}
+	if err != nil {
+		if s.debug {
+			log.Printf("Not tunnel traffic: %v", err)
+		}
+		s.answerNonTunnel(w, msg, labels)
+		return
 	}
 
-	// Connect using IPv4 address
-	addr := net.JoinHostPort(ipv4.String(), port)
-	conn, err := dialer.Dial("tcp4", addr)
+	if s.authority != nil {
+		msg.Authoritative = true
+	}
+
+	f, cipher, err := s.openFrame(decodedData)
 	if err != nil {
-		return nil, fmt.Errorf("connection failed: %v", err)
+		if s.debug {
+			log.Printf("Rejected frame: %v", err)
+		}
+		// Tampered, replayed or unauthenticated frames are refused
+		msg.Rcode = dns.RcodeFormatError
+		if s.psk != nil || s.identity != nil {
+			msg.Rcode = dns.RcodeRefused
+		}
+		w.WriteMsg(msg)
+		return
 	}
 
-	// Set keepalive
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	if s.debug {
+		log.Printf("Parsed request:")
+		log.Printf("  Codec: %s", codec.Name())
+		log.Printf("  Frame type: %s", frameTypeName(f.Type))
+		log.Printf("  Session ID: %08x", f.Session)
+		log.Printf("  Sequence: %d", f.Seq)
+		log.Printf("  Payload: %d bytes", len(f.Payload))
 	}
 
-	session := &Session{
-		conn:       conn,
-		lastActive: time.Now(),
+	// Probes are answered with a digest of what arrived, which tells the
+	// client whether its query came through intact, padded on request to
+	// show how large an answer makes it back
+	if f.Type == frameProbe {
+		digest := sha256.Sum256(f.Payload)
+		size := len(digest)
+		if f.Flags&flagFill != 0 {
+			size = s.dataBudget(w, r, msg, question, false)
+		}
+		s.writeFrame(w, msg, question, nil, &frame{Type: frameProbe, Session: f.Session, Payload: probeAnswer(digest[:], size)})
+		return
 	}
 
-	return session, nil
+	if f.Type == frameHandshake {
+		reply, err := s.handleHandshake(f)
+		if err != nil {
+			if s.debug {
+				log.Printf("Handshake failed: %v", err)
+			}
+			s.writeFrame(w, msg, question, nil, &frame{Type: frameRst, Session: f.Session})
+			return
+		}
+		s.writeFrame(w, msg, question, nil, reply)
+		return
+	}
+
+	// FIN and RST tear down the session without creating one
+	if f.Type == frameFin || f.Type == frameRst {
+		s.closeSession(f.Session)
+		s.writeFrame(w, msg, question, cipher, &frame{Type: f.Type, Session: f.Session, Ack: f.Seq})
+		return
+	}
+
+	// Get or create session
+	session, err := s.getSession(f.Session, &sessionAuth{cipher: cipher})
+	if err != nil {
+		if s.debug {
+			log.Printf("Failed to get/create session: %v", err)
+		}
+		s.writeFrame(w, msg, question, cipher, &frame{Type: frameRst, Session: f.Session})
+		return
+	}
+
+	// Every authenticated frame keeps the session alive, since polls are
+	// all a session whose streams are quiet sends, and acknowledges the
+	// downstream data the client has received
+	session.touch()
+	session.acknowledge(f.Ack)
+
+	switch f.Type {
+	case framePoll:
+		budget := s.dataBudget(w, r, msg, question, cipher != nil)
+		s.writeFrame(w, msg, question, cipher, s.handlePoll(session, f.Session, budget))
+
+	case frameData:
+		if session.IsClosed() {
+			s.writeFrame(w, msg, question, cipher, &frame{Type: frameFin, Session: f.Session})
+			return
+		}
+
+		if s.debug {
+			log.Printf("Delivering chunk %d (%d bytes)", f.Seq, len(f.Payload))
+		}
+
+		ack, accepted, err := session.deliver(f.Seq, f.Payload)
+		if err != nil {
+			if s.debug {
+				log.Printf("Failed to write to connection: %v", err)
+			}
+			session.Close()
+			s.writeFrame(w, msg, question, cipher, &frame{Type: frameRst, Session: f.Session})
+			return
+		}
+
+		// Echo the sequence so the client knows this chunk arrived even
+		// when an earlier gap holds back the cumulative ack
+		response := &frame{Type: frameKeepalive, Session: f.Session, Seq: f.Seq, Ack: ack}
+		if accepted {
+			response.Flags |= flagReceived
+		}
+		s.writeFrame(w, msg, question, cipher, response)
+
+	case frameKeepalive:
+		s.writeFrame(w, msg, question, cipher, &frame{Type: frameKeepalive, Session: f.Session, Ack: session.ackSeq()})
+	}
 }
 
 func (s *DNSServer) cleanupSessions() {
@@ -505,17 +1187,19 @@ func (s *DNSServer) cleanupSessions() {
 		s.mu.Lock()
 		now := time.Now()
 		for id, session := range s.sessions {
-			if session.IsClosed() || now.Sub(session.lastActive) > 5*time.Minute {
+			inactive := now.Sub(session.lastActivity()) > 5*time.Minute
+			if session.IsClosed() || inactive {
 				if s.debug {
-					log.Printf("Cleaning up session: %s (closed: %v, inactive: %v)",
+					log.Printf("Cleaning up session: %08x (closed: %v, inactive: %v)",
 						id,
 						session.IsClosed(),
-						now.Sub(session.lastActive) > 5*time.Minute)
+						inactive)
 				}
 				session.Close()
 				delete(s.sessions, id)
 			}
 		}
 		s.mu.Unlock()
+		s.forgetPSKCiphers()
 	}
 }
@@ -0,0 +1,172 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol values (RFC 1928)
+const (
+	socksVersion      = 0x05
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+	socksConnect      = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+)
+
+// socksHandshakeTimeout bounds how long a SOCKS5 client may take to send
+// its request
+const socksHandshakeTimeout = 10 * time.Second
+
+// handleSOCKS5 reads a SOCKS5 CONNECT request and carries the connection as
+// a stream to the target it names. Success is only reported once the server
+// has connected to the target.
+func (c *DNSClient) handleSOCKS5(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := readSOCKS5Request(conn)
+	if err != nil {
+		if c.debug {
+			log.Printf("SOCKS5 request from %s failed: %v", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if c.debug {
+		log.Printf("SOCKS5 CONNECT to %s", target)
+	}
+
+	stream, err := c.connectStream(target)
+	if err != nil {
+		log.Printf("SOCKS5 CONNECT to %s failed: %v", target, err)
+		writeSOCKS5Reply(conn, socksFailureCode(err))
+		conn.Close()
+		return
+	}
+
+	if err := writeSOCKS5Reply(conn, socksSucceeded); err != nil {
+		stream.abort()
+		conn.Close()
+		return
+	}
+	if stream.attach(conn) {
+		<-stream.done
+	}
+}
+
+// socksFailureCode returns the reply code for why a stream could not be
+// connected
+func socksFailureCode(err error) byte {
+	var refused *refusal
+	if !errors.As(err, &refused) {
+		return socksGeneralFailure
+	}
+	switch refused.reason {
+	case resetNotAllowed:
+		return socksNotAllowed
+	case resetUnreachable:
+		return socksHostUnreachable
+	case resetRefused:
+		return socksConnectionRefused
+	default:
+		return socksGeneralFailure
+	}
+}
+
+// readSOCKS5Request negotiates the method, which must be no
+// authentication, and returns the host:port of a CONNECT request.
+// Unsupported requests are answered with the matching failure.
+func readSOCKS5Request(conn net.Conn) (string, error) {
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return "", err
+	}
+	if greeting[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if !bytes.Contains(methods, []byte{socksNoAuth}) {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", fmt.Errorf("client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	// VER CMD RSV ATYP, then the address and port
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socksIPv4, socksIPv6:
+		addr := make([]byte, net.IPv4len)
+		if header[3] == socksIPv6 {
+			addr = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+
+	case socksDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+
+	default:
+		writeSOCKS5Reply(conn, socksAddressNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", header[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+
+	if header[1] != socksConnect {
+		writeSOCKS5Reply(conn, socksCommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", header[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeSOCKS5Reply sends a reply with the given code. The bound address is
+// left unspecified since the real one is on the server.
+func writeSOCKS5Reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,221 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the media type of DNS messages carried over HTTPS
+const dohContentType = "application/dns-message"
+
+// dotPort is the port DNS over TLS resolvers listen on (RFC 7858)
+const dotPort = "853"
+
+// maxIdleStreams caps the stream connections kept open between queries
+const maxIdleStreams = 16
+
+// transport carries a query to the resolver and returns its answer along
+// with the measured round trip time
+type transport interface {
+	exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error)
+}
+
+// newTransport returns the transport for a resolver address: DNS over
+// HTTPS for an https:// URL, DNS over TLS for tls://host[:port], otherwise
+// plain DNS to host:port
+func newTransport(server string, debug bool) transport {
+	if strings.HasPrefix(server, "https://") {
+		return &dohTransport{
+			url:    server,
+			client: &http.Client{},
+		}
+	}
+
+	if addr, ok := strings.CutPrefix(server, "tls://"); ok {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+			addr = net.JoinHostPort(addr, dotPort)
+		}
+		return &dnsTransport{
+			server: addr,
+			tcp: &dns.Client{
+				Net:          "tcp-tls",
+				TLSConfig:    &tls.Config{ServerName: host},
+				ReadTimeout:  2 * time.Second,
+				WriteTimeout: 2 * time.Second,
+			},
+			debug: debug,
+		}
+	}
+
+	return &dnsTransport{
+		server: server,
+		udp: &dns.Client{
+			Net:          "udp",
+			ReadTimeout:  2 * time.Second,
+			WriteTimeout: 2 * time.Second,
+		},
+		tcp: &dns.Client{
+			Net:          "tcp",
+			ReadTimeout:  2 * time.Second,
+			WriteTimeout: 2 * time.Second,
+		},
+		debug: debug,
+	}
+}
+
+// dnsTransport sends queries over UDP, retrying truncated answers over the
+// stream client. Without a UDP client, as for DNS over TLS, every query
+// goes over the stream.
+type dnsTransport struct {
+	server   string
+	udp      *dns.Client
+	tcp      *dns.Client
+	forceTCP bool
+	debug    bool
+
+	// Stream connections waiting for the next query
+	mu   sync.Mutex
+	idle []*dns.Conn
+}
+
+func (t *dnsTransport) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if t.forceTCP || t.udp == nil {
+		return t.exchangeStream(ctx, msg)
+	}
+
+	r, rtt, err := t.udp.ExchangeContext(ctx, msg, t.server)
+	if err == nil && r.Truncated {
+		if t.debug {
+			log.Printf("Answer was truncated, retrying over TCP")
+		}
+		return t.exchangeStream(ctx, msg)
+	}
+	return r, rtt, err
+}
+
+// exchangeStream sends a query over a stream connection, reusing an idle
+// one so TCP and TLS setup is not paid on every query. The server may have
+// closed an idle connection, so a failure on one is retried on the next.
+func (t *dnsTransport) exchangeStream(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	for {
+		conn, reused := t.takeIdle(), true
+		if conn == nil {
+			var err error
+			conn, err = t.tcp.DialContext(ctx, t.server)
+			if err != nil {
+				return nil, 0, err
+			}
+			reused = false
+		}
+
+		r, rtt, err := t.tcp.ExchangeWithConnContext(ctx, msg, conn)
+		if err != nil {
+			conn.Close()
+			if reused && ctx.Err() == nil {
+				continue
+			}
+			return nil, 0, err
+		}
+		t.putIdle(conn)
+		return r, rtt, nil
+	}
+}
+
+func (t *dnsTransport) takeIdle() *dns.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) == 0 {
+		return nil
+	}
+	conn := t.idle[len(t.idle)-1]
+	t.idle = t.idle[:len(t.idle)-1]
+	return conn
+}
+
+func (t *dnsTransport) putIdle(conn *dns.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) >= maxIdleStreams {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, conn)
+}
+
+// dohTransport sends queries as DNS over HTTPS requests (RFC 8484), in the
+// body of a POST or, with get, in the dns parameter of a GET
+type dohTransport struct {
+	url    string
+	client *http.Client
+	get    bool
+}
+
+func (t *dohTransport) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// A zero ID keeps identical queries cacheable; HTTP pairs the answer
+	// with its request instead
+	query := msg.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to pack query: %v", err)
+	}
+
+	var req *http.Request
+	if t.get {
+		sep := "?"
+		if strings.Contains(t.url, "?") {
+			sep = "&"
+		}
+		url := t.url + sep + "dns=" + base64.RawURLEncoding.EncodeToString(packed)
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(packed))
+		if err == nil {
+			req.Header.Set("Content-Type", dohContentType)
+		}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to build request: %v", err)
+	}
+	req.Header.Set("Accept", dohContentType)
+
+	start := time.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize+1))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, fmt.Errorf("failed to read answer: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("resolver returned HTTP %s", resp.Status)
+	}
+	if len(body) > dns.MaxMsgSize {
+		return nil, rtt, fmt.Errorf("answer exceeds %d bytes", dns.MaxMsgSize)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, rtt, fmt.Errorf("failed to unpack answer: %v", err)
+	}
+	r.Id = msg.Id
+	return r, rtt, nil
+}
@@ -0,0 +1,297 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// Maximum distance ahead of the next expected sequence that will be buffered
+const maxReorderWindow = 256
+
+// Window and retransmission tuning
+const (
+	defaultWindowSize = 8
+	minRTO            = 200 * time.Millisecond
+	maxRTO            = dnsTimeout
+	initialRTO        = time.Second
+)
+
+// seqLess reports whether sequence a comes before b, accounting for 16-bit
+// wraparound (RFC 1982 serial number arithmetic)
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// recvWindow reorders and deduplicates sequenced chunks. It is not safe for
+// concurrent use; callers hold their own lock so delivery stays ordered.
+type recvWindow struct {
+	next    uint16
+	pending map[uint16][]byte
+}
+
+func newRecvWindow() *recvWindow {
+	return &recvWindow{
+		pending: make(map[uint16][]byte),
+	}
+}
+
+// push accepts a chunk and returns the payloads that can now be delivered in
+// order. Retransmitted chunks are dropped but still count as accepted; chunks
+// too far ahead are rejected and must be sent again.
+func (w *recvWindow) push(seq uint16, data []byte) ([][]byte, bool) {
+	if seqLess(seq, w.next) {
+		// Already delivered, resolver or client retry
+		return nil, true
+	}
+	if seq-w.next >= maxReorderWindow {
+		// Too far ahead, the sender will retransmit
+		return nil, false
+	}
+	if seq != w.next {
+		if _, exists := w.pending[seq]; !exists {
+			w.pending[seq] = data
+		}
+		return nil, true
+	}
+
+	ready := [][]byte{data}
+	w.next++
+	for {
+		chunk, exists := w.pending[w.next]
+		if !exists {
+			break
+		}
+		delete(w.pending, w.next)
+		ready = append(ready, chunk)
+		w.next++
+	}
+	return ready, true
+}
+
+// ack returns the highest contiguous sequence received so far. Before
+// anything arrives this is 0xffff, one before the first sequence.
+func (w *recvWindow) ack() uint16 {
+	return w.next - 1
+}
+
+// segment is a sequenced chunk awaiting acknowledgement
+type segment struct {
+	seq      uint16
+	data     []byte
+	sent     time.Time
+	retries  int
+	received bool // Peer confirmed it holds this chunk out of order
+}
+
+// sendWindow holds sequenced chunks until the peer acknowledges them so lost
+// answers can be replayed. Like recvWindow it relies on the caller's lock.
+type sendWindow struct {
+	next    uint16
+	unacked []*segment
+	rtt     rttEstimator
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{}
+}
+
+// add assigns the next sequence to data and queues it for delivery
+func (w *sendWindow) add(data []byte) *segment {
+	seg := &segment{seq: w.next, data: data}
+	w.next++
+	w.unacked = append(w.unacked, seg)
+	return seg
+}
+
+// acknowledge drops every queued segment up to and including ack, sampling
+// the round trip of those that were only sent once
+func (w *sendWindow) acknowledge(ack uint16) {
+	now := time.Now()
+	i := 0
+	for i < len(w.unacked) && !seqLess(ack, w.unacked[i].seq) {
+		if seg := w.unacked[i]; seg.retries == 0 && !seg.sent.IsZero() {
+			w.rtt.sample(now.Sub(seg.sent))
+		}
+		i++
+	}
+	w.unacked = w.unacked[i:]
+}
+
+// nextToSend returns the oldest segment that has never been sent or whose
+// last transmission has gone unacknowledged for longer than the RTO, marking
+// it as sent. It returns nil when nothing is due.
+func (w *sendWindow) nextToSend() *segment {
+	now := time.Now()
+	rto := w.rtt.rto()
+	for _, seg := range w.unacked {
+		if seg.sent.IsZero() {
+			seg.sent = now
+			return seg
+		}
+		if now.Sub(seg.sent) > rto {
+			seg.sent = now
+			seg.retries++
+			return seg
+		}
+	}
+	return nil
+}
+
+// len returns the number of unacknowledged segments
+func (w *sendWindow) len() int {
+	return len(w.unacked)
+}
+
+// rttEstimator tracks a smoothed round trip time as in RFC 6298
+type rttEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	min    time.Duration
+}
+
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if e.srtt == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.min = rtt
+		return
+	}
+
+	delta := e.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	e.rttvar = (3*e.rttvar + delta) / 4
+	e.srtt = (7*e.srtt + rtt) / 8
+	if rtt < e.min {
+		e.min = rtt
+	}
+}
+
+// rto returns the retransmission timeout derived from the samples so far
+func (e *rttEstimator) rto() time.Duration {
+	if e.srtt == 0 {
+		return initialRTO
+	}
+
+	rto := e.srtt + 4*e.rttvar
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	return rto
+}
+
+// congestionWindow limits how many queries a session keeps in flight. It
+// grows additively while answers come back promptly and halves on loss or
+// when round trips climb well above the best one observed.
+type congestionWindow struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	cwnd     float64
+	ssthresh float64
+	max      int
+	inflight int
+	rtt      rttEstimator
+	closed   bool
+}
+
+func newCongestionWindow(max int) *congestionWindow {
+	if max < 1 {
+		max = 1
+	}
+	if max > maxReorderWindow {
+		max = maxReorderWindow
+	}
+
+	w := &congestionWindow{
+		cwnd:     1,
+		ssthresh: float64(max),
+		max:      max,
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// acquire blocks until a query slot is free. It returns false once the
+// window has been closed.
+func (w *congestionWindow) acquire() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for !w.closed && w.inflight >= int(w.cwnd) {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return false
+	}
+	w.inflight++
+	return true
+}
+
+// release frees a slot taken by acquire
+func (w *congestionWindow) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.inflight--
+	w.cond.Broadcast()
+}
+
+// onSuccess grows the window after an answered query
+func (w *congestionWindow) onSuccess(rtt time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.rtt.sample(rtt)
+
+	// Queueing delay on the resolver path counts as congestion
+	if w.rtt.min > 0 && rtt > 4*w.rtt.min && rtt > minRTO {
+		w.shrink()
+		return
+	}
+
+	if w.cwnd < w.ssthresh {
+		w.cwnd++
+	} else {
+		w.cwnd += 1 / w.cwnd
+	}
+	if w.cwnd > float64(w.max) {
+		w.cwnd = float64(w.max)
+	}
+	w.cond.Broadcast()
+}
+
+// onLoss shrinks the window after a query went unanswered
+func (w *congestionWindow) onLoss() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.shrink()
+}
+
+func (w *congestionWindow) shrink() {
+	w.ssthresh = w.cwnd / 2
+	if w.ssthresh < 1 {
+		w.ssthresh = 1
+	}
+	w.cwnd = w.ssthresh
+}
+
+// timeout returns how long to wait for an answer before treating the query
+// as lost
+func (w *congestionWindow) timeout() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rtt.rto()
+}
+
+// close wakes every waiter and makes further acquire calls fail
+func (w *congestionWindow) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	w.cond.Broadcast()
+}
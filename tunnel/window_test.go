@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{0, 1, true},
+		{1, 0, false},
+		{5, 5, false},
+		{0xffff, 0x0000, true},
+		{0x0000, 0xffff, false},
+		{0xfff0, 0x0010, true},
+		{0x0010, 0xfff0, false},
+		{0, 0x7fff, true},
+		{0, 0x8001, false},
+	}
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqLess(%#04x, %#04x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRecvWindowPush(t *testing.T) {
+	type push struct {
+		seq   uint16
+		ready string // payloads delivered, concatenated
+		ok    bool
+	}
+	tests := []struct {
+		name   string
+		next   uint16
+		pushes []push
+		ack    uint16
+	}{
+		{
+			name:   "in order",
+			pushes: []push{{0, "0", true}, {1, "1", true}, {2, "2", true}},
+			ack:    2,
+		},
+		{
+			name:   "duplicates",
+			pushes: []push{{0, "0", true}, {0, "", true}, {2, "", true}, {2, "", true}, {1, "12", true}, {1, "", true}},
+			ack:    2,
+		},
+		{
+			name:   "gaps",
+			pushes: []push{{3, "", true}, {1, "", true}, {0, "01", true}, {2, "23", true}, {5, "", true}},
+			ack:    3,
+		},
+		{
+			name:   "nothing received",
+			pushes: []push{{1, "", true}},
+			ack:    0xffff,
+		},
+		{
+			name:   "across wrap",
+			next:   0xfffe,
+			pushes: []push{{0x0000, "", true}, {0xfffe, "fffe", true}, {0xfffd, "", true}, {0xffff, "ffff0", true}, {0x0001, "1", true}},
+			ack:    0x0001,
+		},
+		{
+			name:   "duplicate before wrap",
+			next:   0x0002,
+			pushes: []push{{0xffff, "", true}, {0x0002, "2", true}},
+			ack:    0x0002,
+		},
+		{
+			name:   "beyond reorder window",
+			pushes: []push{{maxReorderWindow, "", false}, {maxReorderWindow - 1, "", true}, {0x1000, "", false}},
+			ack:    0xffff,
+		},
+		{
+			name:   "beyond reorder window across wrap",
+			next:   0xff80,
+			pushes: []push{{0x0080, "", false}, {0x007f, "", true}},
+			ack:    0xff7f,
+		},
+	}
+	for _, tt := range tests {
+		w := newRecvWindow()
+		w.next = tt.next
+		for _, p := range tt.pushes {
+			ready, ok := w.push(p.seq, []byte(fmt.Sprintf("%x", p.seq)))
+			var got string
+			for _, chunk := range ready {
+				got += string(chunk)
+			}
+			if got != p.ready || ok != p.ok {
+				t.Errorf("%s: push(%#04x) = %q, %v, want %q, %v", tt.name, p.seq, got, ok, p.ready, p.ok)
+			}
+		}
+		if ack := w.ack(); ack != tt.ack {
+			t.Errorf("%s: ack() = %#04x, want %#04x", tt.name, ack, tt.ack)
+		}
+	}
+}